@@ -1,20 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"net/http"
-	"net/url"
+	"log/slog"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
+
+	"crowdstrike-cli/pkg/rtr"
 )
 
-// loadEnvFile loads environment variables from .env file
-func loadEnvFile(envPath string) error {
+// loadEnvFile loads environment variables from .env file and returns the numbers of the
+// lines it skipped because they are not KEY=VALUE assignments or open a quote that is never closed
+func loadEnvFile(envPath string) ([]int, error) {
 	if envPath == "" {
 		envPath = ".env"
 	}
@@ -22,366 +39,2897 @@ func loadEnvFile(envPath string) error {
 	file, err := os.Open(envPath)
 	if err != nil {
 		// .env file doesn't exist, that's okay
-		return nil
+		return nil, nil
 	}
 	defer file.Close()
 
 	content, err := io.ReadAll(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var malformed []int
+
 	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
-		if strings.Contains(line, "=") {
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
+		// Shell-style files prefix assignments with export
+		line = strings.TrimPrefix(line, "export ")
 
-				// Remove quotes if present
-				if len(value) >= 2 {
-					if (strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`)) ||
-						(strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'")) {
-						value = value[1 : len(value)-1]
-					}
-				}
+		key, value, found := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			malformed = append(malformed, i+1)
+			continue
+		}
 
-				os.Setenv(key, value)
+		// A quoted value without its closing quote continues on the following lines. One that
+		// is never closed is reported instead of swallowing the assignments after it
+		if unclosedQuote(value) {
+			joined, last := value, i
+			for unclosedQuote(joined) && last+1 < len(lines) {
+				last++
+				joined += "\n" + strings.TrimRight(lines[last], "\r")
+			}
+			if !quoteClosesValue(joined) {
+				malformed = append(malformed, i+1)
+				continue
 			}
+			value, i = joined, last
+		}
+
+		value = parseEnvValue(value)
+
+		// Variables already set in the environment take precedence over the file
+		if _, exists := os.LookupEnv(key); !exists {
+			os.Setenv(key, value)
 		}
 	}
 
-	return nil
+	return malformed, nil
 }
 
-// RTRClient represents a CrowdStrike Real-Time Response client
-type RTRClient struct {
-	authURL      string
-	baseURL      string
-	clientID     string
-	clientSecret string
-	httpClient   *http.Client
-	headers      map[string]string
+// unclosedQuote reports whether value starts with a quote that it does not also close
+func unclosedQuote(value string) bool {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return false
+	}
+	return closingQuote(value) < 0
+}
+
+// quoteClosesValue reports whether the quote value starts with is closed at its end, leaving
+// at most a # comment after it
+func quoteClosesValue(value string) bool {
+	end := closingQuote(value)
+	if end < 0 {
+		return false
+	}
+	rest := value[end+1:]
+	trimmed := strings.TrimLeft(rest, " \t")
+	return trimmed == "" || (trimmed[0] == '#' && len(trimmed) < len(rest))
 }
 
-// NewRTRClient creates a new RTRClient instance
-func NewRTRClient(clientID, clientSecret, baseURL string, verifyCert bool) *RTRClient {
-	if baseURL == "" {
-		baseURL = "https://api.crowdstrike.com"
+// closingQuote returns the index of the quote closing the one value starts with, or -1.
+// Inside double quotes a backslash escapes the next character; single quotes have no escapes
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch {
+		case value[i] == value[0]:
+			return i
+		case value[0] == '"' && value[i] == '\\':
+			i++
+		}
 	}
+	return -1
+}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// envEscapes maps the characters after a backslash in a double-quoted value to their meaning
+var envEscapes = map[byte]byte{'n': '\n', 'r': '\r', 't': '\t', '"': '"', '\\': '\\'}
+
+// unescapeEnvValue expands the escapes of a double-quoted value; unknown escapes are kept as written
+func unescapeEnvValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			if c, ok := envEscapes[value[i+1]]; ok {
+				b.WriteByte(c)
+				i++
+				continue
+			}
+		}
+		b.WriteByte(value[i])
 	}
+	return b.String()
+}
 
-	if !verifyCert {
-		// Note: In production, you should properly handle certificate verification
-		// This is a simplified version
-		client.Transport = &http.Transport{
-			// TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// parseEnvValue removes surrounding quotes from a .env value, or a trailing # comment from
+// an unquoted one; quoted values keep any # and = characters they contain. Escapes such as
+// \n and \" are expanded in double-quoted values, while single-quoted values are taken literally
+func parseEnvValue(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		if end := closingQuote(value); end > 0 {
+			if value[0] == '"' {
+				return unescapeEnvValue(value[1:end])
+			}
+			return value[1:end]
 		}
 	}
 
-	return &RTRClient{
-		authURL:      baseURL,
-		baseURL:      baseURL + "/real-time-response",
-		clientID:     clientID,
-		clientSecret: clientSecret,
-		httpClient:   client,
-		headers:      make(map[string]string),
+	// A comment must be preceded by whitespace so values such as a#b are kept intact
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = value[:idx]
 	}
+	if idx := strings.Index(value, "\t#"); idx >= 0 {
+		value = value[:idx]
+	}
+	return strings.TrimSpace(value)
 }
 
-// Authenticate authenticates to CrowdStrike API using id and secret
-func (c *RTRClient) Authenticate() error {
-	payload := url.Values{}
-	payload.Set("client_id", c.clientID)
-	payload.Set("client_secret", c.clientSecret)
+// resolveSetting returns the flag value if set, otherwise the named environment variable
+func resolveSetting(flagValue, envKey string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(envKey)
+}
 
-	req, err := http.NewRequest("POST", c.authURL+"/oauth2/token", strings.NewReader(payload.Encode()))
-	if err != nil {
-		return err
+// envCredentials is the default credential provider: the -client-id and -client-secret
+// flags or the -profile credentials when given, otherwise CLIENT_ID and CLIENT_SECRET from
+// the environment or .env
+type envCredentials struct {
+	clientID     string
+	clientSecret string
+}
+
+// Credentials resolves the client ID and secret each time a token is requested
+func (e envCredentials) Credentials() (string, string, error) {
+	id := resolveSetting(e.clientID, "CLIENT_ID")
+	secret := resolveSetting(e.clientSecret, "CLIENT_SECRET")
+	if id == "" || secret == "" {
+		return "", "", errors.New("CLIENT_ID and CLIENT_SECRET must be set via flags, environment variables or .env file")
 	}
+	return id, secret, nil
+}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// runSummary tallies per-host outcomes for the end-of-run report
+type runSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Offline   int `json:"offline"`
+	Skipped   int `json:"skipped"`
+	// Suppressed counts results left out of the output by -match or -no-match
+	Suppressed int `json:"suppressed,omitempty"`
+	// HiddenSuccesses counts successful results left out of the output by -failures-only
+	HiddenSuccesses int `json:"hidden_successes,omitempty"`
+
+	mu sync.Mutex
+}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return err
+// add records the outcome of a single host
+func (s *runSummary) add(result rtr.HostResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case result.Offline:
+		s.Offline++
+	case result.Failed():
+		s.Failed++
+	default:
+		s.Succeeded++
 	}
-	defer resp.Body.Close()
+}
+
+// suppress records a result that was not printed
+func (s *runSummary) suppress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Suppressed++
+}
+
+// hideSuccess records a successful result that was not printed
+func (s *runSummary) hideSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.HiddenSuccesses++
+}
 
-	if resp.StatusCode != 201 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("authentication failed: %s", string(body))
+// exitCode returns failCode if any host failed or was offline, otherwise 0
+func (s *runSummary) exitCode(failCode int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Failed > 0 || s.Offline > 0 {
+		return failCode
 	}
+	return 0
+}
+
+// print writes the summary to stderr; hosts without any result are counted as skipped
+func (s *runSummary) print(asJSON bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Skipped = s.Total - s.Succeeded - s.Failed - s.Offline
 
-	var authResp struct {
-		AccessToken string `json:"access_token"`
-		TokenType   string `json:"token_type"`
+	if asJSON {
+		line, err := json.Marshal(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding summary: %v\n", err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, string(line))
+		return
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
-		return err
+	fmt.Fprintf(os.Stderr, "Summary: %d targeted, %d succeeded, %d failed, %d offline, %d skipped",
+		s.Total, s.Succeeded, s.Failed, s.Offline, s.Skipped)
+	if s.Suppressed > 0 {
+		fmt.Fprintf(os.Stderr, ", %d suppressed", s.Suppressed)
+	}
+	if s.HiddenSuccesses > 0 {
+		fmt.Fprintf(os.Stderr, ", %d successful hidden", s.HiddenSuccesses)
 	}
+	fmt.Fprintln(os.Stderr)
+}
 
-	c.headers["Authorization"] = "Bearer " + authResp.AccessToken
-	c.headers["token_type"] = "bearer"
-	c.headers["Content-Type"] = "application/json"
+// progress shows completed and total host counts with a rate on a single stderr line
+type progress struct {
+	total int
+	start time.Time
 
-	return nil
+	// mu serializes updates with the console output printed around the line
+	mu   sync.Mutex
+	done int
+	// width is the length of the line on screen, 0 while none is shown
+	width int
 }
 
-// HostSearch searches for hosts in your environment - Returns a list of agent IDs
-func (c *RTRClient) HostSearch(criteria, criteriaType, rawFilter string, limit int) ([]string, error) {
-	reqURL := c.authURL + "/devices/queries/devices/v1"
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return nil, err
+// newProgress returns a progress display for total hosts, or nil when it should stay hidden
+// because of -quiet or because stderr is not a terminal
+func newProgress(total int, quiet bool) *progress {
+	if quiet || !isTerminal(os.Stderr) {
+		return nil
 	}
+	return &progress{total: total, start: time.Now()}
+}
 
-	// Set headers
-	for k, v := range c.headers {
-		req.Header.Set(k, v)
+// add records n more finished hosts and redraws the line
+func (p *progress) add(n int) {
+	if p == nil {
+		return
 	}
 
-	// Build query parameters
-	q := req.URL.Query()
-	if criteria != "" && criteriaType != "" {
-		q.Set("filter", fmt.Sprintf("%s:'%s'", criteriaType, criteria))
-	} else if rawFilter != "" {
-		q.Set("filter", rawFilter)
-	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	if limit > 0 {
-		q.Set("limit", fmt.Sprintf("%d", limit))
-	}
-	req.URL.RawQuery = q.Encode()
+	p.done += n
+	p.draw()
+}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
+// draw writes the line over the previous one; callers hold mu
+func (p *progress) draw() {
+	rate := float64(p.done) / time.Since(p.start).Seconds()
+	line := fmt.Sprintf("%d/%d hosts done (%.1f hosts/s)", p.done, p.total, rate)
+	fmt.Fprintf(os.Stderr, "\r%-*s", p.width, line)
+	p.width = len(line)
+}
+
+// around clears the line, runs print and draws the line again below its output, so results
+// printed to the same terminal neither overwrite the line nor get overwritten by it
+func (p *progress) around(print func()) {
+	if p == nil {
+		print()
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("host search failed: %s", string(body))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.width == 0 {
+		print()
+		return
 	}
+	fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", p.width))
+	print()
+	p.draw()
+}
 
-	var result struct {
-		Resources []string `json:"resources"`
+// finish ends the progress line so later output starts on a new line
+func (p *progress) finish() {
+	if p == nil {
+		return
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.width > 0 {
+		fmt.Fprintln(os.Stderr)
+		p.width = 0
 	}
+}
 
-	return result.Resources, nil
+// resultWriter emits host results in the requested format, either to the console
+// or to one file per host when dir is set
+type resultWriter struct {
+	format string
+	dir    string
+
+	// mu serializes console output across worker goroutines
+	mu sync.Mutex
+	// csv is created with its header row on the first CSV result
+	csv *csv.Writer
+	// tmpl, when set, formats each text result instead of the default layout
+	tmpl *template.Template
+	// bar, when set, is the progress line that console output is printed around
+	bar *progress
 }
 
-// BatchInit initializes an RTR session across multiple hosts
-func (c *RTRClient) BatchInit(hostIDs []string, timeout, timeoutDuration string) (string, error) {
-	reqURL := c.baseURL + "/combined/batch-init-session/v1"
+// templateFuncs are the helper functions available to -template
+var templateFuncs = template.FuncMap{
+	"trim": strings.TrimSpace,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
 
-	// Build query parameters
-	q := url.Values{}
-	if timeout != "" {
-		q.Set("timeout", timeout)
-	}
-	if timeoutDuration != "" {
-		q.Set("timeout_duration", timeoutDuration)
+// parseResultTemplate parses a -template string; a trailing newline is added when missing so
+// each host's output starts on its own line
+func parseResultTemplate(text string) (*template.Template, error) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
 	}
-	if len(q) > 0 {
-		reqURL += "?" + q.Encode()
+	return template.New("result").Funcs(templateFuncs).Parse(text)
+}
+
+// render executes the result template for one host
+func (w *resultWriter) render(result rtr.HostResult) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, result); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	payload := map[string]interface{}{
-		"host_ids": hostIDs,
+// csvHeader is the header row for CSV output
+var csvHeader = []string{"host_id", "complete", "offline", "exit_code", "stdout", "stderr", "error"}
+
+// csvRecord converts a host result to a CSV row matching csvHeader
+func csvRecord(result rtr.HostResult) []string {
+	return []string{
+		result.HostID,
+		strconv.FormatBool(result.Complete),
+		strconv.FormatBool(result.Offline),
+		strconv.Itoa(result.ExitCode()),
+		result.Stdout,
+		result.Stderr,
+		result.ErrorMessage,
 	}
+}
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return "", err
+// writeRaw prints a batch response as indented JSON for diagnosing unexpected response shapes
+func (w *resultWriter) writeRaw(body []byte) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		// Show the response as received when it is not valid JSON
+		buf.Reset()
+		buf.Write(body)
 	}
 
-	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", err
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.bar.around(func() {
+		fmt.Println(buf.String())
+	})
+}
+
+// write emits a single host result; in text mode stdout goes to the process stdout
+// and stderr to the process stderr
+func (w *resultWriter) write(result rtr.HostResult) {
+	if w.dir != "" {
+		// A failed write only affects this host, the rest of the run continues
+		if err := w.writeFile(result); err != nil {
+			slog.Error("could not write result file", "host", result.HostID, "error", err)
+		}
+		return
 	}
 
-	// Set headers
-	for k, v := range c.headers {
-		req.Header.Set(k, v)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.bar.around(func() {
+		w.writeConsole(result)
+	})
+}
+
+// writeConsole prints a result to stdout, and its stderr to the process stderr in text mode;
+// callers hold mu
+func (w *resultWriter) writeConsole(result rtr.HostResult) {
+	if w.tmpl != nil {
+		content, err := w.render(result)
+		if err != nil {
+			slog.Error("could not render result template", "host", result.HostID, "error", err)
+			return
+		}
+		os.Stdout.Write(content)
+		return
 	}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return "", err
+	if w.format == "csv" {
+		if w.csv == nil {
+			w.csv = csv.NewWriter(os.Stdout)
+			w.csv.Write(csvHeader)
+		}
+		w.csv.Write(csvRecord(result))
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			slog.Error("could not write CSV row", "host", result.HostID, "error", err)
+		}
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("batch init failed: %s", string(body))
+	if w.format == "json" {
+		line, err := json.Marshal(result)
+		if err != nil {
+			fmt.Printf("Error encoding result for host %s: %v\n", result.HostID, err)
+			return
+		}
+		fmt.Println(string(line))
+		return
 	}
 
-	var result struct {
-		BatchID string `json:"batch_id"`
+	if result.Offline {
+		fmt.Printf("Host %s is offline or unreachable\n", result.Label())
+	}
+	if result.ErrorMessage != "" {
+		fmt.Printf("Error for host %s: %s\n", result.Label(), result.ErrorMessage)
+	}
+	if result.Stdout != "" {
+		if result.Hostname != "" {
+			fmt.Printf("== %s ==\n", result.Label())
+		}
+		fmt.Println(result.Stdout)
+	}
+	if result.Stderr != "" {
+		fmt.Fprintln(os.Stderr, result.Stderr)
 	}
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+// header prints a line introducing a group of results, on stdout in text mode and on
+// stderr otherwise so JSON and CSV output stay machine-readable
+func (w *resultWriter) header(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.bar.around(func() {
+		if w.format == "text" && w.dir == "" {
+			fmt.Println(line)
+			return
+		}
+		fmt.Fprintln(os.Stderr, line)
+	})
+}
+
+// writeFile writes a host result to <dir>/<host id>.txt, or .json/.csv in JSON/CSV mode
+func (w *resultWriter) writeFile(result rtr.HostResult) error {
+	ext := ".txt"
+	var content []byte
+
+	if w.format == "csv" {
+		ext = ".csv"
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		cw.Write(csvHeader)
+		cw.Write(csvRecord(result))
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		content = buf.Bytes()
+	} else if w.format == "json" {
+		ext = ".json"
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		content = append(data, '\n')
+	} else if w.tmpl != nil {
+		var err error
+		if content, err = w.render(result); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if result.Offline {
+			buf.WriteString("Host is offline or unreachable\n")
+		}
+		if result.ErrorMessage != "" {
+			fmt.Fprintf(&buf, "Error: %s\n", result.ErrorMessage)
+		}
+		buf.WriteString(result.Stdout)
+		if result.Stderr != "" {
+			fmt.Fprintf(&buf, "\n--- stderr ---\n%s\n", result.Stderr)
+		}
+		content = buf.Bytes()
 	}
 
-	return result.BatchID, nil
+	// Host IDs are hex strings, but never let one escape the output directory
+	name := filepath.Join(w.dir, filepath.Base(result.HostID)+ext)
+	return os.WriteFile(name, content, 0644)
 }
 
-// BatchAdminCmd executes an RTR admin command across all hosts mapped to a batch ID
-func (c *RTRClient) BatchAdminCmd(batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
-	reqURL := c.baseURL + "/combined/batch-admin-command/v1"
+// auditRecord is one line of the audit log, written for every host a command was sent to
+type auditRecord struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Operator    string    `json:"operator"`
+	HostID      string    `json:"host_id"`
+	Hostname    string    `json:"hostname,omitempty"`
+	BaseCommand string    `json:"base_command"`
+	Command     string    `json:"command"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+}
 
-	// Build query parameters
-	q := url.Values{}
-	if timeout > 0 {
-		q.Set("timeout", fmt.Sprintf("%d", timeout))
-	}
-	if timeoutDuration != "" {
-		q.Set("timeout_duration", timeoutDuration)
+// auditLog appends JSON lines describing each host command to a file that is never truncated
+type auditLog struct {
+	operator string
+
+	// mu serializes records written by worker goroutines
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens path for appending, creating it readable only by the owner
+func openAuditLog(path, operator string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
 	}
-	if len(q) > 0 {
-		reqURL += "?" + q.Encode()
+	return &auditLog{operator: operator, file: file}, nil
+}
+
+// record appends the outcome of running cmd on the result's host
+func (a *auditLog) record(result rtr.HostResult, baseCmd, cmd string) error {
+	outcome := "success"
+	if result.Offline {
+		outcome = "offline"
+	} else if result.Failed() {
+		outcome = "failed"
 	}
 
-	payload := map[string]interface{}{
-		"base_command":  command,
-		"batch_id":      batchID,
-		"command_string": commandString,
+	line, err := json.Marshal(auditRecord{
+		Timestamp:   time.Now().UTC(),
+		Operator:    a.operator,
+		HostID:      result.HostID,
+		Hostname:    result.Hostname,
+		BaseCommand: baseCmd,
+		Command:     cmd,
+		Outcome:     outcome,
+		Error:       result.ErrorMessage,
+	})
+	if err != nil {
+		return err
 	}
 
-	if len(optionalHosts) > 0 {
-		payload["optional_hosts"] = optionalHosts
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close flushes and closes the audit file
+func (a *auditLog) Close() error {
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
 	}
+	return a.file.Close()
+}
+
+// stateFile appends the IDs of hosts whose command completed, one per line, so a run that was
+// interrupted can be started again with the same file and skip them. It is written from the
+// single reporting goroutine
+type stateFile struct {
+	file *os.File
+}
 
-	jsonData, err := json.Marshal(payload)
+// readStateFile returns the hosts recorded as completed in path; a missing file means none
+func readStateFile(path string) (map[string]bool, error) {
+	hosts, err := readListFile(path)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(jsonData))
+	done := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		done[host] = true
+	}
+	return done, nil
+}
+
+// openStateFile opens path for appending completed hosts
+func openStateFile(path string) (*stateFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
+	return &stateFile{file: file}, nil
+}
 
-	// Set headers
-	for k, v := range c.headers {
-		req.Header.Set(k, v)
+// record appends the result's host when its command completed. Offline, timed-out and
+// errored hosts are left out so a resumed run tries them again
+func (s *stateFile) record(result rtr.HostResult) error {
+	if !result.Complete || result.Offline || result.Failed() {
+		return nil
 	}
+	_, err := s.file.WriteString(result.HostID + "\n")
+	return err
+}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
+// Close flushes and closes the state file
+func (s *stateFile) Close() error {
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// defaultOperator identifies who ran the tool when -operator is not given
+func defaultOperator() string {
+	if operator := os.Getenv("CS_OPERATOR"); operator != "" {
+		return operator
 	}
-	defer resp.Body.Close()
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return os.Getenv("USERNAME")
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// runAll calls fn for every batch using goroutines, with at most workers running concurrently.
+// A panic in fn is recovered and passed to onPanic with its batch so the rest of the run continues
+func runAll[T any](batches []T, workers int, fn func(batch T), onPanic func(batch T, recovered interface{})) {
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, workers)
+
+	for _, batch := range batches {
+		semaphore <- struct{}{} // Acquire semaphore
+		wg.Add(1)
+
+		go func(b T) {
+			// Deferred in reverse: recover first, then release the slot, then mark done
+			defer wg.Done()
+			defer func() { <-semaphore }() // Release semaphore
+			defer func() {
+				if r := recover(); r != nil {
+					onPanic(b, r)
+				}
+			}()
+			fn(b)
+		}(batch)
 	}
 
-	return body, nil
+	wg.Wait()
 }
 
-func runcmd(rtrClient *RTRClient, host string, script string, wg *sync.WaitGroup) {
-	defer wg.Done()
+// batchOutcome is a finished batch and the results of its hosts
+type batchOutcome struct {
+	job     batchJob
+	results []rtr.HostResult
+}
 
-	hosts := []string{host}
-	sessionID, err := rtrClient.BatchInit(hosts, "30", "30s")
-	if err != nil {
-		fmt.Printf("Error initializing batch for host %s: %v\n", host, err)
-		return
+// collectResults runs jobs with runAll and passes each finished batch to handle on a single
+// goroutine, so output from different batches never interleaves. Workers block once buffer
+// batches are waiting, which keeps a slow consumer from piling up results in memory. run may
+// pass results of hosts that finished early to emit before returning the batch's results; a
+// job for which run returns nil is not reported further
+func collectResults(jobs []batchJob, workers, buffer int, run func(job batchJob, emit func([]rtr.HostResult)) []rtr.HostResult, onPanic func(batchJob, interface{}) []rtr.HostResult, handle func(batchOutcome)) {
+	finished := make(chan batchOutcome, buffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for outcome := range finished {
+			handle(outcome)
+		}
+	}()
+
+	runAll(jobs, workers, func(job batchJob) {
+		emit := func(results []rtr.HostResult) {
+			finished <- batchOutcome{job: job, results: results}
+		}
+		if results := run(job, emit); results != nil {
+			emit(results)
+		}
+	}, func(job batchJob, recovered interface{}) {
+		finished <- batchOutcome{job: job, results: onPanic(job, recovered)}
+	})
+
+	close(finished)
+	<-done
+}
+
+// hostStream routes the results OnHostResult reports while a batch is still polling to the
+// batch they belong to, so hosts that finish early are reported before the rest of their batch
+type hostStream struct {
+	mu    sync.Mutex
+	emits map[string]func([]rtr.HostResult)
+}
+
+// register passes the results of hosts to emit until they are unregistered
+func (s *hostStream) register(hosts []string, emit func([]rtr.HostResult)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emits == nil {
+		s.emits = make(map[string]func([]rtr.HostResult))
+	}
+	for _, host := range hosts {
+		s.emits[host] = emit
 	}
+}
 
-	cmd := "runscript -Raw=```" + script + "```"
-	execResult, err := rtrClient.BatchAdminCmd(sessionID, "runscript", cmd, 30, "10m", hosts)
-	if err != nil {
-		fmt.Printf("Error executing command for host %s: %v\n", host, err)
-		return
+// unregister stops passing on the results of hosts
+func (s *hostStream) unregister(hosts []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, host := range hosts {
+		delete(s.emits, host)
 	}
+}
 
-	stdout := strings.ReplaceAll(string(execResult), "'", `"`)
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(stdout), &data); err != nil {
-		return
+// deliver passes a completed host's result to its batch; it is the client's OnHostResult
+func (s *hostStream) deliver(result rtr.HostResult) {
+	s.mu.Lock()
+	emit := s.emits[result.HostID]
+	s.mu.Unlock()
+
+	if emit != nil {
+		emit([]rtr.HostResult{result})
 	}
+}
+
+// version and commit identify this build; release builds set them with
+// -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = ""
+)
 
-	// Try to extract stdout from the nested structure
-	if combined, ok := data["combined"].(map[string]interface{}); ok {
-		if resources, ok := combined["resources"].(map[string]interface{}); ok {
-			if hostData, ok := resources[host].(map[string]interface{}); ok {
-				if stdout, ok := hostData["stdout"].(string); ok {
-					fmt.Println(stdout)
+// versionString describes the build for -version: version, git commit and Go version
+func versionString() string {
+	rev := commit
+	if rev == "" {
+		// Builds of the package rather than the single file record the commit themselves
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					rev = setting.Value
 				}
 			}
 		}
 	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	return fmt.Sprintf("crowdstrike-cli %s (commit %s, %s)", version, rev, runtime.Version())
 }
 
-func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: cli <hostname> <script>")
-		os.Exit(1)
+// runSelection describes how the targets of a run were chosen
+type runSelection struct {
+	Source    string `json:"source"`
+	Filter    string `json:"filter,omitempty"`
+	HostsFile string `json:"hosts_file,omitempty"`
+}
+
+// noHostsExitCode is the exit code when the host selection matches nothing, so scripts can
+// tell an empty search apart from failed hosts
+const noHostsExitCode = 3
+
+// describe summarizes the selection for messages
+func (s runSelection) describe() string {
+	if s.HostsFile != "" {
+		return "the hosts in " + s.HostsFile
 	}
+	return "filter " + s.Filter
+}
+
+// manifestCommand is a distinct command sent during a run
+type manifestCommand struct {
+	BaseCommand string `json:"base_command"`
+	Command     string `json:"command"`
+}
+
+// runManifest records what a run did so it can be reviewed or replayed later
+type runManifest struct {
+	Version    string            `json:"version"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Selection  runSelection      `json:"selection"`
+	Hosts      []string          `json:"hosts"`
+	Commands   []manifestCommand `json:"commands"`
+	Summary    *runSummary       `json:"summary"`
+}
 
-	// Load environment variables from .env file
-	if err := loadEnvFile(".env"); err != nil {
-		fmt.Printf("Warning: Could not load .env file: %v\n", err)
+// manifestCommands lists the distinct commands of jobs in the order they first appear
+func manifestCommands(jobs []batchJob) []manifestCommand {
+	var commands []manifestCommand
+	seen := make(map[manifestCommand]bool)
+	for _, job := range jobs {
+		command := manifestCommand{BaseCommand: job.baseCmd(), Command: job.cmd()}
+		if !seen[command] {
+			seen[command] = true
+			commands = append(commands, command)
+		}
 	}
+	return commands
+}
 
-	clientID := os.Getenv("CLIENT_ID")
-	apiKey := os.Getenv("CLIENT_SECRET")
+// write saves the manifest as indented JSON
+func (m *runManifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
 
-	if clientID == "" || apiKey == "" {
-		fmt.Println("Error: CLIENT_ID and CLIENT_SECRET must be set in .env file or environment variables")
-		os.Exit(1)
+// writeMetrics writes API and run metrics to path in the Prometheus text exposition format.
+// The file is replaced atomically so a textfile collector never reads it half-written
+func writeMetrics(path string, stats rtr.ClientStats, summary *runSummary, runDuration time.Duration) error {
+	var b strings.Builder
+
+	b.WriteString("# HELP crowdstrike_cli_api_requests_total API responses by endpoint and HTTP status code.\n")
+	b.WriteString("# TYPE crowdstrike_cli_api_requests_total counter\n")
+	for _, e := range stats.Endpoints {
+		codes := make([]int, 0, len(e.Responses))
+		for code := range e.Responses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(&b, "crowdstrike_cli_api_requests_total{method=%q,path=%q,code=\"%d\"} %d\n", e.Method, e.Path, code, e.Responses[code])
+		}
 	}
 
-	rtrClient := NewRTRClient(clientID, apiKey, "", true)
-	if err := rtrClient.Authenticate(); err != nil {
-		fmt.Printf("Error authenticating: %v\n", err)
-		os.Exit(1)
+	b.WriteString("# HELP crowdstrike_cli_api_request_errors_total API requests that got no response, by endpoint.\n")
+	b.WriteString("# TYPE crowdstrike_cli_api_request_errors_total counter\n")
+	for _, e := range stats.Endpoints {
+		fmt.Fprintf(&b, "crowdstrike_cli_api_request_errors_total{method=%q,path=%q} %d\n", e.Method, e.Path, e.Errors)
 	}
 
-	hosts, err := rtrClient.HostSearch(os.Args[1], "hostname", "", 5000)
-	if err != nil {
-		fmt.Printf("Error searching for hosts: %v\n", err)
-		os.Exit(1)
+	b.WriteString("# HELP crowdstrike_cli_api_request_duration_seconds Time spent on API requests, by endpoint.\n")
+	b.WriteString("# TYPE crowdstrike_cli_api_request_duration_seconds summary\n")
+	for _, e := range stats.Endpoints {
+		count := e.Errors
+		for _, n := range e.Responses {
+			count += n
+		}
+		fmt.Fprintf(&b, "crowdstrike_cli_api_request_duration_seconds_sum{method=%q,path=%q} %g\n", e.Method, e.Path, e.Duration.Seconds())
+		fmt.Fprintf(&b, "crowdstrike_cli_api_request_duration_seconds_count{method=%q,path=%q} %d\n", e.Method, e.Path, count)
 	}
 
-	script := os.Args[2]
+	b.WriteString("# HELP crowdstrike_cli_auth_duration_seconds Time spent requesting OAuth tokens.\n")
+	b.WriteString("# TYPE crowdstrike_cli_auth_duration_seconds summary\n")
+	fmt.Fprintf(&b, "crowdstrike_cli_auth_duration_seconds_sum %g\n", stats.AuthDuration.Seconds())
+	fmt.Fprintf(&b, "crowdstrike_cli_auth_duration_seconds_count %d\n", stats.Authentications)
+
+	b.WriteString("# HELP crowdstrike_cli_run_duration_seconds Wall time of the run.\n")
+	b.WriteString("# TYPE crowdstrike_cli_run_duration_seconds gauge\n")
+	fmt.Fprintf(&b, "crowdstrike_cli_run_duration_seconds %g\n", runDuration.Seconds())
+
+	b.WriteString("# HELP crowdstrike_cli_hosts Hosts in the last run, by outcome.\n")
+	b.WriteString("# TYPE crowdstrike_cli_hosts gauge\n")
+	for _, outcome := range []struct {
+		name  string
+		count int
+	}{
+		{"succeeded", summary.Succeeded},
+		{"failed", summary.Failed},
+		{"offline", summary.Offline},
+		{"skipped", summary.Skipped},
+	} {
+		fmt.Fprintf(&b, "crowdstrike_cli_hosts{result=%q} %d\n", outcome.name, outcome.count)
+	}
 
-	// Use goroutines with WaitGroup for parallel execution (similar to ThreadPoolExecutor)
-	var wg sync.WaitGroup
-	maxWorkers := 32
-	semaphore := make(chan struct{}, maxWorkers)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
 
-	for _, host := range hosts {
-		wg.Add(1)
-		semaphore <- struct{}{} // Acquire semaphore
+// batchJob is a batch of hosts and the commands they all run, in order, in one RTR batch session
+type batchJob struct {
+	hosts    []string
+	commands []string
+}
 
-		go func(h string) {
-			defer func() { <-semaphore }() // Release semaphore
-			runcmd(rtrClient, h, script, &wg)
-			time.Sleep(200 * time.Millisecond) // Equivalent to time.sleep(0.2)
-		}(host)
+// baseCmd is the base command of the job's first command
+func (j batchJob) baseCmd() string {
+	return baseCommand(j.commands[0])
+}
+
+// cmd is the job's commands, one per line
+func (j batchJob) cmd() string {
+	return strings.Join(j.commands, "\n")
+}
+
+// planJobs splits hosts into batchJobs of at most batchSize hosts running commands
+func planJobs(hosts []string, batchSize int, commands []string) []batchJob {
+	var jobs []batchJob
+	for _, batch := range rtr.ChunkHosts(hosts, batchSize) {
+		jobs = append(jobs, batchJob{hosts: batch, commands: commands})
 	}
+	return jobs
+}
 
-	wg.Wait()
+// groupByPlatform splits hosts by the platform reported in details, returning the hosts for
+// each platform that has a script and the hosts left without one
+func groupByPlatform(hosts []string, details map[string]rtr.HostInfo, scripts map[string]string) (map[string][]string, []string) {
+	groups := make(map[string][]string)
+	var unmatched []string
+	for _, host := range hosts {
+		platform := details[host].PlatformName
+		if scripts[platform] == "" {
+			unmatched = append(unmatched, host)
+			continue
+		}
+		groups[platform] = append(groups[platform], host)
+	}
+	return groups, unmatched
 }
 
+// batchPollInterval is how often a batch with hosts still running is polled
+const batchPollInterval = 5 * time.Second
+
+// batchTimeoutSlack is extra time a batch gets beyond the host timeout for session setup and transfer
+const batchTimeoutSlack = time.Minute
+
+// runcmd runs RTR commands in order on a batch of hosts sharing a single RTR batch session and
+// returns a result for every host. With several commands, each host's output is collected under
+// a "> command" line per command, and a host stops at its first failure unless continueOnError
+// is set. onResponse, when not nil, receives each final batch response before it is parsed.
+// Hosts that fail to initialize are reported with the reason and get no commands. A batch-level
+// failure of the first command is returned as an error and leaves reporting to the caller; a
+// later one is recorded on the hosts still running the sequence.
+func runcmd(ctx context.Context, rtrClient *rtr.RTRClient, hosts []string, commands []string, hostTimeout time.Duration, continueOnError bool, onResponse func([]byte)) ([]rtr.HostResult, error) {
+	// Bound the whole batch so a hung request cannot hold a worker past the host timeout
+	limit := time.Duration(len(commands))*hostTimeout + batchTimeoutSlack
+	batchCtx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+
+	// timedOut replaces a deadline error from the batch context with a clearer message
+	timedOut := func(step string, err error) error {
+		if batchCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return fmt.Errorf("%s: timed out after %s", step, limit)
+		}
+		return fmt.Errorf("%s: %w", step, err)
+	}
+
+	initResult, err := rtrClient.BatchInitHostsContext(batchCtx, hosts, "30", "30s")
+	if err != nil {
+		return nil, timedOut("initializing batch", err)
+	}
+	sessionID := initResult.BatchID
+	defer func() {
+		// Interrupted batches stay tracked so their sessions are closed during shutdown
+		if batchCtx.Err() == nil {
+			rtrClient.ReleaseBatch(sessionID)
+		}
+	}()
+
+	// Hosts that failed to initialize get no commands and are reported with the reason
+	collected := make(map[string]rtr.HostResult, len(hosts))
+	for host, reason := range initResult.Failed {
+		collected[host] = rtr.HostResult{HostID: host, ErrorMessage: "session init failed: " + reason}
+	}
+	active := initResult.Initialized(hosts)
+	for i, cmd := range commands {
+		if len(active) == 0 {
+			break
+		}
+
+		stepResults, err := execBatchCommand(batchCtx, rtrClient, sessionID, active, cmd, hostTimeout, onResponse)
+		if err != nil {
+			err = timedOut("executing command", err)
+			// Keep init failures reported alongside the batch error rather than overwriting them
+			if i == 0 && len(initResult.Failed) == 0 {
+				return nil, err
+			}
+			for _, host := range active {
+				result := collected[host]
+				result.ErrorMessage = fmt.Sprintf("%s: %v", cmd, err)
+				collected[host] = result
+			}
+			break
+		}
+
+		var next []string
+		for _, result := range stepResults {
+			if len(commands) == 1 {
+				collected[result.HostID] = result
+				continue
+			}
+
+			merged := collected[result.HostID]
+			merged.HostID = result.HostID
+			merged.Stdout += fmt.Sprintf("> %s\n%s\n", cmd, result.Stdout)
+			if result.Stderr != "" {
+				merged.Stderr += fmt.Sprintf("> %s\n%s\n", cmd, result.Stderr)
+			}
+			if result.ErrorMessage != "" {
+				msg := cmd + ": " + result.ErrorMessage
+				if merged.ErrorMessage != "" {
+					msg = merged.ErrorMessage + "; " + msg
+				}
+				merged.ErrorMessage = msg
+			}
+			merged.Complete = result.Complete
+			merged.Offline = result.Offline
+			collected[result.HostID] = merged
+
+			// Offline hosts cannot run the rest of the sequence
+			if !result.Offline && (continueOnError || !result.Failed()) {
+				next = append(next, result.HostID)
+			}
+		}
+		active = next
+	}
+
+	results := make([]rtr.HostResult, 0, len(hosts))
+	for _, host := range hosts {
+		results = append(results, collected[host])
+	}
+	return results, nil
+}
+
+// execBatchCommand runs one command on hosts in an open batch session, polling for hosts that
+// are still running, and returns a result per host with missing hosts marked offline and
+// hosts that did not finish within hostTimeout marked as timed out
+func execBatchCommand(ctx context.Context, rtrClient *rtr.RTRClient, sessionID string, hosts []string, cmd string, hostTimeout time.Duration, onResponse func([]byte)) ([]rtr.HostResult, error) {
+	seconds := int(hostTimeout / time.Second)
+	execResult, err := rtrClient.BatchRunCmdContext(ctx, sessionID, baseCommand(cmd), cmd, seconds, fmt.Sprintf("%ds", seconds), hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The command call can return before every host finishes; poll for the rest until the deadline
+	if reqID := rtr.BatchRequestID(execResult); reqID != "" {
+		deadline, _ := ctx.Deadline()
+		polled, err := rtrClient.WaitForBatchCommandContext(ctx, sessionID, reqID, batchPollInterval, time.Until(deadline))
+		if polled != nil {
+			execResult = polled
+		} else if err != nil {
+			rtrClient.Logger.Warn("could not poll for incomplete hosts", "batch_id", sessionID, "error", err)
+		}
+	}
+
+	if onResponse != nil {
+		onResponse(execResult)
+	}
+
+	// A response without host results is reported on each host rather than as offline hosts
+	parsed, err := rtr.ParseBatchResults(execResult)
+	missingResources := errors.Is(err, rtr.ErrNoBatchResources)
+	if missingResources {
+		rtrClient.Logger.Warn("unexpected batch response shape", "batch_id", sessionID, "error", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("parsing response: %w", err)
+	}
+
+	results := make([]rtr.HostResult, 0, len(hosts))
+	for _, host := range hosts {
+		result, found := parsed[host]
+		if missingResources {
+			result = rtr.HostResult{HostID: host, ErrorMessage: "no result for host in batch response"}
+		} else if !found {
+			// Hosts that are offline or unreachable are left out of the response
+			result = rtr.HostResult{HostID: host, Offline: true}
+		} else if !result.Complete && !result.Offline && result.ErrorMessage == "" {
+			// The API returns stragglers as incomplete once the command timeout passes
+			result.ErrorMessage = fmt.Sprintf("timed out after %s", hostTimeout)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// runGetFile retrieves path from a batch of hosts with the RTR get command and saves each host's
+// copy to <dir>/<host id>.7z, the password-protected archive the API serves. It returns a result
+// per host saying where the file was saved or why it was not. A batch-level failure before any
+// host is reported is returned as an error, as with runcmd
+func runGetFile(ctx context.Context, rtrClient *rtr.RTRClient, hosts []string, path, dir string, hostTimeout time.Duration) ([]rtr.HostResult, error) {
+	// The file still has to upload after the get command finishes, within the same bound
+	limit := hostTimeout + batchTimeoutSlack
+	batchCtx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+
+	initResult, err := rtrClient.BatchInitHostsContext(batchCtx, hosts, "30", "30s")
+	if err != nil {
+		return nil, fmt.Errorf("initializing batch: %w", err)
+	}
+	batchID := initResult.BatchID
+	defer func() {
+		// Interrupted batches stay tracked so their sessions are closed during shutdown
+		if batchCtx.Err() == nil {
+			rtrClient.ReleaseBatch(batchID)
+		}
+	}()
+
+	collected := make(map[string]rtr.HostResult, len(hosts))
+	for host, reason := range initResult.Failed {
+		collected[host] = rtr.HostResult{HostID: host, ErrorMessage: "session init failed: " + reason}
+	}
+	active := initResult.Initialized(hosts)
+
+	var requests map[string]rtr.GetRequest
+	if len(active) > 0 {
+		seconds := int(hostTimeout / time.Second)
+		requests, err = rtrClient.BatchGetCmdContext(batchCtx, batchID, path, seconds, fmt.Sprintf("%ds", seconds), active)
+		if err != nil {
+			if len(initResult.Failed) == 0 {
+				return nil, fmt.Errorf("requesting file: %w", err)
+			}
+			for _, host := range active {
+				collected[host] = rtr.HostResult{HostID: host, ErrorMessage: fmt.Sprintf("requesting file: %v", err)}
+			}
+			active = nil
+		}
+	}
+
+	// Hosts that accepted the get command upload the file; the rest are offline or failed
+	pending := make(map[string]bool)
+	reqID := ""
+	for _, host := range active {
+		request, found := requests[host]
+		switch {
+		case !found:
+			collected[host] = rtr.HostResult{HostID: host, Offline: true}
+		case request.Stderr != "":
+			collected[host] = rtr.HostResult{HostID: host, Complete: true, Stderr: request.Stderr}
+		default:
+			pending[host] = true
+			reqID = request.BatchGetCmdReqID
+		}
+	}
+
+	// Poll until every pending host's file has been uploaded or the batch runs out of time
+	uploads := make(map[string]rtr.GetRequest, len(pending))
+	var waitErr error
+	for len(pending) > 0 {
+		status, err := rtrClient.BatchGetCmdStatusContext(batchCtx, reqID)
+		if err != nil {
+			waitErr = err
+			break
+		}
+		for host, request := range status {
+			if pending[host] && request.Complete {
+				uploads[host] = request
+			}
+		}
+		if len(uploads) == len(pending) {
+			break
+		}
+
+		select {
+		case <-batchCtx.Done():
+			waitErr = batchCtx.Err()
+		case <-time.After(batchPollInterval):
+		}
+		if waitErr != nil {
+			break
+		}
+	}
+
+	for host := range pending {
+		upload, ok := uploads[host]
+		if !ok {
+			msg := fmt.Sprintf("timed out after %s waiting for the file", limit)
+			if waitErr != nil && !errors.Is(waitErr, context.DeadlineExceeded) {
+				msg = fmt.Sprintf("waiting for the file: %v", waitErr)
+			}
+			collected[host] = rtr.HostResult{HostID: host, ErrorMessage: msg}
+			continue
+		}
+
+		result := rtr.HostResult{HostID: host, Complete: true}
+		content, err := rtrClient.GetExtractedFileContext(batchCtx, upload.SHA256, upload.SessionID)
+		if err == nil {
+			// Host IDs are hex strings, but never let one escape the output directory
+			name := filepath.Join(dir, filepath.Base(host)+".7z")
+			if err = os.WriteFile(name, content, 0600); err == nil {
+				result.Stdout = fmt.Sprintf("Saved %s (sha256 %s) to %s", path, upload.SHA256, name)
+			}
+		}
+		if err != nil {
+			result.ErrorMessage = fmt.Sprintf("downloading file: %v", err)
+		}
+		collected[host] = result
+	}
+
+	results := make([]rtr.HostResult, 0, len(hosts))
+	for _, host := range hosts {
+		results = append(results, collected[host])
+	}
+	return results, nil
+}
+
+// baseCommand returns the RTR base command of a command string, e.g. "ls" for "ls C:\Windows"
+func baseCommand(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// sortResults orders results by agent ID for "host", or by hostname for "hostname" with
+// hosts of unknown hostname last, ordered by agent ID
+func sortResults(results []rtr.HostResult, by string) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if by == "hostname" && a.Hostname != b.Hostname {
+			if a.Hostname == "" || b.Hostname == "" {
+				return b.Hostname == ""
+			}
+			return strings.ToLower(a.Hostname) < strings.ToLower(b.Hostname)
+		}
+		return a.HostID < b.HostID
+	})
+}
+
+// failedResults reports the same batch-level error for every host in the batch
+func failedResults(hosts []string, err error) []rtr.HostResult {
+	results := make([]rtr.HostResult, 0, len(hosts))
+	for _, host := range hosts {
+		results = append(results, rtr.HostResult{HostID: host, ErrorMessage: err.Error()})
+	}
+	return results
+}
+
+// interactiveCommandTimeout is how long an interactive command may run, matching the
+// timeout_duration sent with it
+const interactiveCommandTimeout = 10 * time.Minute
+
+// runInteractive opens a session on a single host and runs commands read from in, one per
+// line, until "exit", end of input or cancellation. The session is refreshed in the
+// background so it stays open while the operator is idle, and left for CloseActiveSessions
+func runInteractive(ctx context.Context, rtrClient *rtr.RTRClient, host string, in io.Reader, out io.Writer) error {
+	initResult, err := rtrClient.BatchInitHostsContext(ctx, []string{host}, "30", "30s")
+	if err != nil {
+		return fmt.Errorf("initializing session: %w", err)
+	}
+	if reason, failed := initResult.Failed[host]; failed {
+		return fmt.Errorf("initializing session: %s", reason)
+	}
+	batchID := initResult.BatchID
+
+	// Keep the session alive between commands
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+	go func() {
+		ticker := time.NewTicker(rtrClient.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-refreshCtx.Done():
+				return
+			case <-ticker.C:
+				if err := rtrClient.RefreshSessionContext(refreshCtx, batchID, nil); err != nil {
+					rtrClient.Logger.Warn("could not refresh session", "batch_id", batchID, "error", err)
+				}
+			}
+		}
+	}()
+
+	// Read input on its own goroutine so Ctrl-C is noticed while waiting for a line
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		fmt.Fprint(out, "rtr> ")
+
+		var line string
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(out)
+			return ctx.Err()
+		case l, ok := <-lines:
+			if !ok {
+				fmt.Fprintln(out)
+				return nil
+			}
+			line = strings.TrimSpace(l)
+		}
+
+		if line == "" {
+			continue
+		}
+		if line == "exit" || line == "quit" {
+			return nil
+		}
+
+		baseCmd := strings.Fields(line)[0]
+		body, err := rtrClient.BatchRunCmdContext(ctx, batchID, baseCmd, line, 30, "10m", nil)
+		if err != nil {
+			fmt.Fprintf(out, "Error: %v\n", err)
+			continue
+		}
+
+		// The command call returns after 30 seconds even if the host is still running; poll for the rest
+		if reqID := rtr.BatchRequestID(body); reqID != "" {
+			polled, err := rtrClient.WaitForBatchCommandContext(ctx, batchID, reqID, batchPollInterval, interactiveCommandTimeout)
+			if polled != nil {
+				body = polled
+			} else if err != nil {
+				fmt.Fprintf(out, "Error: waiting for the command to finish: %v\n", err)
+			}
+		}
+
+		results, err := rtr.ParseBatchResults(body)
+		if err != nil {
+			fmt.Fprintf(out, "Error: parsing response: %v\n", err)
+			continue
+		}
+		result, found := results[host]
+		switch {
+		case !found:
+			fmt.Fprintln(out, "Host is offline or unreachable")
+		case result.ErrorMessage != "":
+			fmt.Fprintf(out, "Error: %s\n", result.ErrorMessage)
+		case !result.Complete && !result.Offline:
+			fmt.Fprintln(out, "The command is still running on the host; its output was not collected")
+		}
+		if result.Stdout != "" {
+			fmt.Fprintln(out, result.Stdout)
+		}
+		if result.Stderr != "" {
+			fmt.Fprintln(out, result.Stderr)
+		}
+	}
+}
+
+// rawScriptCommand embeds script in a runscript -Raw command. RTR delimits the script with
+// triple backticks and has no escape for them, so scripts that would end the delimiter early
+// are rejected rather than sent truncated
+func rawScriptCommand(script string) (string, error) {
+	if strings.TrimSpace(script) == "" {
+		return "", fmt.Errorf("script is empty")
+	}
+	if strings.Contains(script, "```") {
+		return "", fmt.Errorf("script contains a triple backtick, which cannot be embedded in runscript -Raw; store it as a cloud script and use -script-name")
+	}
+	if strings.HasPrefix(script, "`") || strings.HasSuffix(script, "`") {
+		return "", fmt.Errorf("script starts or ends with a backtick, which would merge with the runscript -Raw delimiter")
+	}
+	return "runscript -Raw=```" + script + "```", nil
+}
+
+// cloudScriptCommand returns the runscript command for a cloud script. RTR takes the name
+// between double quotes with no escaping, so names containing a double quote are rejected
+func cloudScriptCommand(name string) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("script name is empty")
+	}
+	if strings.Contains(name, `"`) {
+		return "", fmt.Errorf("script name %q contains a double quote, which runscript -CloudFile cannot express", name)
+	}
+	return `runscript -CloudFile="` + name + `"`, nil
+}
+
+// shortcutBaseCommands maps shortcut flags to the RTR base command they run
+var shortcutBaseCommands = map[string]string{
+	"get-file":     "get",
+	"kill-process": "kill",
+	"list-dir":     "ls",
+}
+
+// shortcutCommand returns the RTR base command and arguments for a shortcut flag, quoting
+// paths that contain spaces
+func shortcutCommand(name, value string) (string, string, error) {
+	base, ok := shortcutBaseCommands[name]
+	if !ok {
+		return "", "", fmt.Errorf("unknown shortcut %q", name)
+	}
+
+	if name == "kill-process" {
+		if _, err := strconv.Atoi(value); err != nil {
+			return "", "", fmt.Errorf("-kill-process needs a numeric process ID, got %q", value)
+		}
+		return base, value, nil
+	}
+
+	// Quote without escaping so Windows paths keep single backslashes
+	if strings.ContainsAny(value, " \t") {
+		value = `"` + value + `"`
+	}
+	return base, value, nil
+}
+
+// readScriptFile returns the contents of a script file, or of stdin when path is "-"
+func readScriptFile(path string) (string, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Line endings are kept so multi-line PowerShell runs as written; only trailing blank lines go
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// readListFile reads entries such as hosts or commands from a file, one per line, skipping blanks and # comments
+func readListFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+
+	return hosts, nil
+}
+
+// hostnameLookupSize is how many hostnames are resolved per host search
+const hostnameLookupSize = 100
+
+// hostsFromFile returns the agent IDs for the hosts listed in a file, resolving hostnames
+// through host search, narrowed by filter, unless the entries are already agent IDs, which
+// are validated as for -aid. The hostnames read are returned for unresolvedHostnames
+func hostsFromFile(ctx context.Context, rtrClient *rtr.RTRClient, path string, areIDs bool, filter string) ([]string, []string, error) {
+	entries, err := readListFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if areIDs {
+		ids, err := validateAIDs(entries)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return ids, nil, nil
+	}
+
+	var hosts []string
+	for _, names := range rtr.ChunkHosts(entries, hostnameLookupSize) {
+		ids, err := rtrClient.HostSearchContext(ctx, strings.Join(names, ","), "hostname", filter, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		hosts = append(hosts, ids...)
+	}
+
+	return hosts, entries, nil
+}
+
+// unresolvedHostnames returns the names that match none of the hostnames in details,
+// ignoring case; a name with * wildcards matches as a glob
+func unresolvedHostnames(names []string, details map[string]rtr.HostInfo) []string {
+	var unresolved []string
+	for _, name := range names {
+		pattern := strings.ToLower(name)
+		found := false
+		for _, info := range details {
+			hostname := strings.ToLower(info.Hostname)
+			if hostname == pattern {
+				found = true
+			} else if strings.Contains(pattern, "*") {
+				found, _ = path.Match(pattern, hostname)
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			unresolved = append(unresolved, name)
+		}
+	}
+	return unresolved
+}
+
+// stringList is a flag that may be repeated, collecting every value in order
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// aidPattern matches a CrowdStrike agent ID: 32 hex characters
+var aidPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// validateAIDs normalizes agent IDs to lowercase and rejects malformed ones
+func validateAIDs(aids []string) ([]string, error) {
+	normalized := make([]string, 0, len(aids))
+	for _, aid := range aids {
+		aid = strings.TrimSpace(aid)
+		if !aidPattern.MatchString(aid) {
+			return nil, fmt.Errorf("invalid agent ID %q: expected 32 hex characters", aid)
+		}
+		normalized = append(normalized, strings.ToLower(aid))
+	}
+	return normalized, nil
+}
+
+// confirmThreshold is the host count above which an interactive run asks for confirmation
+const confirmThreshold = 100
+
+// confirmTargets guards broad runs. Above maxHosts (when set) the run needs -yes or an
+// interactive confirmation; above confirmThreshold a terminal user is asked to confirm
+func confirmTargets(count, maxHosts int, assumeYes bool, in *os.File, prompt io.Writer) error {
+	overCap := maxHosts > 0 && count > maxHosts
+	if assumeYes || (!overCap && count <= confirmThreshold) {
+		return nil
+	}
+
+	if !isTerminal(in) {
+		if overCap {
+			return fmt.Errorf("%d hosts matched, above -max-hosts %d; pass -yes to run anyway", count, maxHosts)
+		}
+		return nil
+	}
+
+	fmt.Fprintf(prompt, "Run against %d hosts? [y/N] ", count)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("aborted: run against %d hosts not confirmed", count)
+}
+
+// isTerminal reports whether f is an interactive terminal. The null device is a character
+// device too, but is what scheduled jobs usually get as stdin
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// explicitFlags returns the names of the flags given on the command line
+func explicitFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// Config holds persistent defaults for command-line flags, loaded from a YAML or JSON config file
+type Config struct {
+	// Path is the file the settings were read from
+	Path string
+	// Settings maps flag names with underscores for dashes, such as "batch_size" for -batch-size,
+	// to the values the flag is set to in turn; a repeatable flag may have several
+	Settings map[string][]string
+}
+
+// defaultConfigPath returns ~/.crowdstrike-cli.yaml, or "" if the home directory is unknown
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".crowdstrike-cli.yaml")
+}
+
+// loadConfig reads a YAML or JSON config file; a missing file is only an error when required
+func loadConfig(path string, required bool) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return &Config{Path: path}, nil
+		}
+		return nil, err
+	}
+
+	// A JSON object is decoded as JSON so its escapes and numbers are read exactly
+	var settings map[string][]string
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		settings, err = parseJSONConfig(content)
+	} else {
+		settings, err = parseYAMLConfig(string(content))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	return &Config{Path: path, Settings: settings}, nil
+}
+
+// parseJSONConfig reads the settings of a JSON object
+func parseJSONConfig(content []byte) (map[string][]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string][]string, len(raw))
+	for key, value := range raw {
+		values, err := configValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		settings[key] = values
+	}
+	return settings, nil
+}
+
+// parseYAMLConfig reads the YAML subset a flat settings file needs: "key: value" lines, lists
+// written as [a, b] or as "- item" lines under an empty key, quoted scalars and # comments
+func parseYAMLConfig(content string) (map[string][]string, error) {
+	settings := make(map[string][]string)
+	listKey := ""
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", i+1)
+			}
+			if item, ok := yamlScalar(strings.TrimSpace(trimmed[1:])); ok {
+				settings[listKey] = append(settings[listKey], item)
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested settings are not supported", i+1)
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if _, dup := settings[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", i+1, key)
+		}
+
+		listKey = ""
+		switch {
+		case value == "" || strings.HasPrefix(value, "#"):
+			// Either "- item" lines follow or the setting is left at its default
+			settings[key] = nil
+			listKey = key
+		case strings.HasPrefix(value, "["):
+			items, err := parseYAMLFlowList(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			settings[key] = items
+		default:
+			settings[key] = nil
+			if item, ok := yamlScalar(value); ok {
+				settings[key] = []string{item}
+			}
+		}
+	}
+	return settings, nil
+}
+
+// parseYAMLFlowList splits a [a, "b, c"] list; commas and brackets inside quotes are kept
+func parseYAMLFlowList(value string) ([]string, error) {
+	var items []string
+	rest := strings.TrimSpace(value[1:])
+	for {
+		if strings.HasPrefix(rest, "]") {
+			if tail := strings.TrimSpace(rest[1:]); tail != "" && !strings.HasPrefix(tail, "#") {
+				return nil, fmt.Errorf("unexpected %q after list", tail)
+			}
+			return items, nil
+		}
+
+		start := 0
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			if start = closingQuote(rest) + 1; start == 0 {
+				return nil, fmt.Errorf("unterminated quote in list")
+			}
+		}
+		end := strings.IndexAny(rest[start:], ",]")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated list")
+		}
+		end += start
+
+		if item, ok := yamlScalar(strings.TrimSpace(rest[:end])); ok {
+			items = append(items, item)
+		}
+		rest = rest[end:]
+		if rest[0] == ',' {
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+}
+
+// yamlScalar unquotes a scalar as parseEnvValue does, reporting false for an unquoted null
+func yamlScalar(value string) (string, bool) {
+	quoted := strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'")
+	value = parseEnvValue(value)
+	if !quoted && (value == "" || value == "null" || value == "~") {
+		return "", false
+	}
+	return value, true
+}
+
+// credentialProfile is a named section of the profiles file
+type credentialProfile struct {
+	ClientID     string
+	ClientSecret string
+	Region       string
+}
+
+// defaultProfilesPath returns ~/.crowdstrike-cli/credentials, or "" if the home directory is unknown
+func defaultProfilesPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".crowdstrike-cli", "credentials")
+}
+
+// loadProfile reads the named profile from an INI-style profiles file of [name] sections
+// holding client_id, client_secret and region; values may be quoted as in .env
+func loadProfile(path, name string) (*credentialProfile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile *credentialProfile
+	section := ""
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == name && profile == nil {
+				profile = &credentialProfile{}
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s line %d: expected key = value", path, i+1)
+		}
+		if section != name {
+			continue
+		}
+		value = parseEnvValue(strings.TrimSpace(value))
+		switch strings.TrimSpace(key) {
+		case "client_id":
+			profile.ClientID = value
+		case "client_secret":
+			profile.ClientSecret = value
+		case "region":
+			profile.Region = value
+		default:
+			return nil, fmt.Errorf("%s line %d: unknown key %q", path, i+1, strings.TrimSpace(key))
+		}
+	}
+
+	if profile == nil {
+		return nil, fmt.Errorf("profile %q not found in %s", name, path)
+	}
+	return profile, nil
+}
+
+// configValues converts a JSON config value to the flag values it sets: a string, number or boolean
+// sets one value and a list sets each of its elements in turn, as for a repeatable flag
+func configValues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		var values []string
+		for _, item := range list {
+			itemValues, err := configValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case bool, float64:
+		// Numbers keep their JSON spelling so large integers are not rounded
+		return []string{string(raw)}, nil
+	default:
+		return nil, fmt.Errorf("expected a string, number, boolean or list")
+	}
+}
+
+// applyConfig sets every flag configured in cfg that was not given on the command line,
+// so flags override the file which overrides the built-in defaults. Keys that name no flag
+// are rejected so typos do not go unnoticed
+func applyConfig(cfg *Config, explicit map[string]bool) error {
+	known := make(map[string]bool, len(cfg.Settings))
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		key := strings.ReplaceAll(f.Name, "-", "_")
+		known[key] = true
+		values, ok := cfg.Settings[key]
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+
+		for _, value := range values {
+			if serr := f.Value.Set(value); serr != nil {
+				err = fmt.Errorf("invalid config value for %s: %w", key, serr)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for key := range cfg.Settings {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown config key(s): %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// printScripts lists cloud scripts one per line
+func printScripts(scripts []rtr.Script) {
+	for _, script := range scripts {
+		fmt.Printf("%s\t%s\t%s\t%s\n", script.ID, script.Name, strings.Join(script.Platform, ","), script.Description)
+	}
+}
+
+// printSessions lists RTR sessions one per line
+func printSessions(sessions []rtr.Session) {
+	for _, session := range sessions {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", session.ID, session.HostID, session.Hostname, session.CreatedAt, sessionState(session))
+	}
+}
+
+// sessionState describes whether a session is still open
+func sessionState(session rtr.Session) string {
+	switch {
+	case session.DeletedAt != "":
+		return "closed"
+	case session.Offline:
+		return "offline-queued"
+	default:
+		return "open"
+	}
+}
+
+// fieldValue formats a device field for tab-separated output; lists are joined with commas
+func fieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = fmt.Sprint(item)
+		}
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// printDryRun lists the hosts a run would target without executing anything, showing the
+// hostname and platform, or the given device fields instead
+func printDryRun(hosts []string, details map[string]rtr.HostInfo, fields []string) {
+	for _, host := range hosts {
+		info, ok := details[host]
+		if ok && len(fields) > 0 {
+			values := []string{host}
+			for _, field := range fields {
+				values = append(values, fieldValue(info.Fields[field]))
+			}
+			fmt.Println(strings.Join(values, "\t"))
+			continue
+		}
+		if ok {
+			fmt.Printf("%s\t%s\t%s\n", host, info.Hostname, info.PlatformName)
+			continue
+		}
+		fmt.Println(host)
+	}
+	fmt.Printf("Dry run: %d host(s) matched, no commands were executed\n", len(hosts))
+}
+
+// newLogger builds a logger writing to stderr at the named level, as text or JSON
+func newLogger(level string, jsonFormat bool) (*slog.Logger, error) {
+	var lvl slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "info":
+		lvl = slog.LevelInfo
+	case "warn":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q (expected error, warn, info or debug)", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	if jsonFormat {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+}
+
+func main() {
+	showVersion := flag.Bool("version", false, "Print the version, git commit and Go version, then exit")
+	strictEnv := flag.Bool("strict-env", false, "Fail instead of warning when .env has lines that are not KEY=VALUE assignments")
+	profileName := flag.String("profile", "", "Use the client ID, secret and region of this profile in ~/.crowdstrike-cli/credentials")
+	configPath := flag.String("config", "", "YAML or JSON config file with flag defaults (default ~/.crowdstrike-cli.yaml)")
+	region := flag.String("region", "us-1", "CrowdStrike cloud region (us-1, us-2, eu-1, us-gov-1)")
+	baseURL := flag.String("base-url", "", "API base URL (overrides CS_BASE_URL and -region)")
+	clientIDFlag := flag.String("client-id", "", "CrowdStrike API client ID (overrides CLIENT_ID)")
+	clientSecretFlag := flag.String("client-secret", "", "CrowdStrike API client secret (overrides CLIENT_SECRET)")
+	authURLFlag := flag.String("auth-url", "", "OAuth token host when different from the API host (overrides CS_AUTH_URL)")
+	memberCID := flag.String("cid", "", "Member CID to act on when authenticating as an MSSP parent")
+	clientCert := flag.String("client-cert", "", "PEM client certificate for mutual TLS (requires -client-key)")
+	clientKey := flag.String("client-key", "", "PEM private key for -client-cert")
+	proxy := flag.String("proxy", "", "HTTP/HTTPS proxy URL (overrides HTTPS_PROXY/HTTP_PROXY)")
+	cacheToken := flag.Bool("cache-token", false, "Reuse the OAuth token across runs via ~/.crowdstrike-cli/token.json")
+	rateLimit := flag.Float64("rate", 0, "Maximum API requests per second across all workers (0 = unlimited)")
+	timeout := flag.Duration("timeout", 30*time.Second, "HTTP timeout for each API request; batch command calls wait at least as long as the command timeout")
+	hostTimeout := flag.Duration("host-timeout", 10*time.Minute, "How long each host may take to run the command (30s to 10m)")
+	deadline := flag.Duration("deadline", 0, "Overall time limit for the run; hosts not finished by then are reported as timed out (0 = none)")
+	workers := flag.Int("workers", 32, "Maximum number of batches processed concurrently")
+	batchSize := flag.Int("batch-size", 1000, "Maximum number of hosts per RTR batch session")
+	output := flag.String("output", "text", "Output format: text, json (one JSON object per host) or csv")
+	failFast := flag.Bool("fail-fast", false, "Stop starting new work after the first host fails")
+	failExitCode := flag.Int("fail-exit-code", 1, "Exit code used when any host fails or is offline")
+	summaryJSON := flag.Bool("summary-json", false, "Print the end-of-run summary as JSON")
+	outputDir := flag.String("output-dir", "", "Write each host's result to <dir>/<host id>.txt (.json in JSON mode)")
+	selectBy := flag.String("select-by", "hostname", "Host field to match: hostname, device_id, local_ip, external_ip, platform_name or tag")
+	platform := flag.String("platform", "", "Only target hosts on this platform: windows, linux or mac")
+	seenWithin := flag.Duration("seen-within", 0, "Only target hosts last seen within this long, e.g. 30m or 24h (0 = any)")
+	rawFilter := flag.String("filter", "", "Raw FQL host filter, used instead of the criteria argument")
+	hostsFile := flag.String("hosts-file", "", "File of target hostnames (or agent IDs with -hosts-are-ids), one per line")
+	var aids stringList
+	flag.Var(&aids, "aid", "Agent ID to target directly without a host search (repeatable)")
+	includeHidden := flag.Bool("include-hidden", false, "Also match hosts hidden in the Falcon console (queried from the devices-hidden endpoint)")
+	hostsAreIDs := flag.Bool("hosts-are-ids", false, "Treat -hosts-file entries as agent IDs instead of hostnames")
+	listScripts := flag.Bool("list-scripts", false, "List the custom scripts stored in the RTR cloud and exit")
+	check := flag.Bool("check", false, "Verify credentials and API connectivity, then exit")
+	listSessions := flag.Bool("list-sessions", false, "List RTR sessions visible to the API client and exit")
+	deleteSession := flag.String("delete-session", "", "Close the RTR session with this ID and exit")
+	scriptFile := flag.String("script-file", "", "Read the script to run from a file, or stdin when \"-\"")
+	scriptWindows := flag.String("script-windows", "", "Script to run on Windows hosts when targeting mixed platforms")
+	scriptLinux := flag.String("script-linux", "", "Script to run on Linux hosts when targeting mixed platforms")
+	scriptMac := flag.String("script-mac", "", "Script to run on Mac hosts when targeting mixed platforms")
+	scriptName := flag.String("script-name", "", "Run a cloud script by name instead of the script argument")
+	getFile := flag.String("get-file", "", "Retrieve a file from each host into -output-dir as <host id>.7z (runs get PATH)")
+	killProcess := flag.String("kill-process", "", "Kill a process by ID on each host (runs kill PID)")
+	listDir := flag.String("list-dir", "", "List a directory on each host (runs ls PATH)")
+	commandsFile := flag.String("commands-file", "", "Run the RTR commands in this file, one per line, in order on each batch session")
+	continueOnError := flag.Bool("continue-on-error", false, "Keep running a -commands-file sequence on hosts after a command fails")
+	command := flag.String("command", "", "RTR base command to run instead of runscript, e.g. ls, ps, netstat, reg")
+	commandStringPath := flag.String("command-string", "", "Read a full RTR command string verbatim from this file, or stdin when \"-\", and run it")
+	commandArgs := flag.String("args", "", "Arguments for -command, e.g. a path for ls")
+	interactive := flag.Bool("interactive", false, "Run commands typed on stdin against the single host given with -aid")
+	queueOffline := flag.Bool("queue-offline", false, "Queue the command for offline hosts so it runs when they reconnect")
+	maxHosts := flag.Int("max-hosts", 0, "Refuse to run on more hosts than this without -yes (0 = no cap)")
+	assumeYes := flag.Bool("yes", false, "Skip the confirmation prompt for large runs and allow runs above -max-hosts")
+	raw := flag.Bool("raw", false, "Print each batch's raw API response as indented JSON instead of per-host output")
+	templateText := flag.String("template", "", "Go text/template applied to each host result, e.g. '{{.HostID}}: {{trim .Stdout}}'")
+	failuresOnly := flag.Bool("failures-only", false, "Only print hosts that failed, were offline or wrote to stderr")
+	sortBy := flag.String("sort", "none", "Print results once the run ends, sorted by host (agent ID) or hostname; none prints them as hosts finish")
+	match := flag.String("match", "", "Only print results whose stdout matches this regular expression")
+	noMatch := flag.String("no-match", "", "Only print results whose stdout does not match this regular expression")
+	quiet := flag.Bool("quiet", false, "Hide the progress line shown on stderr during runs")
+	repeat := flag.Bool("repeat", false, "Run again every -interval until interrupted, printing a timestamped header per run")
+	interval := flag.Duration("interval", time.Minute, "Time to wait between runs with -repeat")
+	reresolve := flag.Bool("reresolve", false, "Search for target hosts again before each run with -repeat")
+	dryRun := flag.Bool("dry-run", false, "Resolve and print matching hosts without executing anything")
+	fields := flag.String("fields", "", "Comma-separated device fields to fetch for matched hosts and show with -dry-run, e.g. local_ip,os_version")
+	metricsFile := flag.String("metrics-file", "", "Write API and run metrics to this file in Prometheus text format at the end of the run")
+	manifestPath := flag.String("manifest", "", "Write a JSON manifest of the run (selection, hosts, commands, timing, version) to this file")
+	statePath := flag.String("state-file", "", "Record hosts as they complete and skip hosts already recorded, to resume an interrupted run")
+	auditFile := flag.String("audit-file", "", "Append a JSON record of every host command to this file")
+	operator := flag.String("operator", "", "Operator name for audit records (default CS_OPERATOR or the login user)")
+	logLevel := flag.String("log-level", "error", "Log level: error, warn, info or debug")
+	logJSON := flag.Bool("log-json", false, "Emit logs as JSON")
+
+	flag.Usage = func() {
+		fmt.Println("Usage: cli [options] <criteria> <script>")
+		fmt.Println("       cli [options] -filter <fql> <script>")
+		fmt.Println("       cli [options] -hosts-file <path> <script>")
+		fmt.Println("       cli [options] -script-name <name> <criteria>")
+		fmt.Println("       cli [options] -command <cmd> [-args <args>] <criteria>")
+		fmt.Println("       cli [options] -command-string <file|-> <criteria>")
+		fmt.Println("       cli -list-scripts")
+		fmt.Println("       cli -list-sessions")
+		fmt.Println("       cli -delete-session <session id>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	explicit := explicitFlags()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	// Fill in unset flags from the config file; only an explicit -config must exist
+	cfgPath, cfgRequired := *configPath, true
+	if cfgPath == "" {
+		cfgPath, cfgRequired = defaultConfigPath(), false
+	}
+	if cfgPath != "" {
+		cfg, err := loadConfig(cfgPath, cfgRequired)
+		if err == nil {
+			err = applyConfig(cfg, explicit)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Only one way of targeting hosts may be used at a time
+	if *rawFilter != "" && *hostsFile != "" {
+		fmt.Println("Error: -filter and -hosts-file are mutually exclusive")
+		os.Exit(1)
+	}
+	if *rawFilter != "" && explicit["select-by"] {
+		fmt.Println("Error: -filter and -select-by are mutually exclusive")
+		os.Exit(1)
+	}
+	if len(aids) > 0 && (*rawFilter != "" || *hostsFile != "") {
+		fmt.Println("Error: -aid cannot be combined with -filter or -hosts-file")
+		os.Exit(1)
+	}
+	aidHosts, err := validateAIDs(aids)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	platformClause, err := rtr.PlatformFilter(*platform)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if platformClause != "" && (len(aidHosts) > 0 || *hostsAreIDs) {
+		fmt.Println("Error: -platform needs a host search and cannot be used with -aid or -hosts-are-ids")
+		os.Exit(1)
+	}
+	seenClause, err := rtr.SeenWithinFilter(*seenWithin)
+	if err != nil {
+		fmt.Printf("Error: -seen-within: %v\n", err)
+		os.Exit(1)
+	}
+	if seenClause != "" && (len(aidHosts) > 0 || *hostsAreIDs) {
+		fmt.Println("Error: -seen-within needs a host search and cannot be used with -aid or -hosts-are-ids")
+		os.Exit(1)
+	}
+	// hostClause narrows every host search by platform and recency
+	hostClause := rtr.JoinFilters(platformClause, seenClause)
+	if *interactive && len(aidHosts) != 1 {
+		fmt.Println("Error: -interactive requires exactly one -aid")
+		os.Exit(1)
+	}
+
+	// The criteria argument is replaced by -aid, -filter or -hosts-file when given
+	criteriaArgs := 1
+	if *hostsFile != "" || *rawFilter != "" || len(aidHosts) > 0 {
+		criteriaArgs = 0
+	}
+
+	// Shortcut flags are spelled-out forms of -command and -args
+	shortcutValues := map[string]string{"get-file": *getFile, "kill-process": *killProcess, "list-dir": *listDir}
+	shortcut, shortcutCount := "", 0
+	for name, value := range shortcutValues {
+		if value != "" {
+			shortcut = name
+			shortcutCount++
+		}
+	}
+	platformScripts := map[string]string{"Windows": *scriptWindows, "Linux": *scriptLinux, "Mac": *scriptMac}
+	perPlatform := *scriptWindows != "" || *scriptLinux != "" || *scriptMac != ""
+	if perPlatform && (shortcutCount > 0 || *command != "" || *scriptName != "" || *scriptFile != "") {
+		fmt.Println("Error: -script-windows, -script-linux and -script-mac cannot be combined with other commands or scripts")
+		os.Exit(1)
+	}
+	if shortcutCount > 1 || (shortcutCount == 1 && (*command != "" || *scriptName != "" || *scriptFile != "")) {
+		fmt.Println("Error: use only one of -get-file, -kill-process, -list-dir, -command, -script-name or -script-file")
+		os.Exit(1)
+	}
+	if *getFile != "" && *outputDir == "" {
+		fmt.Println("Error: -get-file needs -output-dir to save the retrieved files in")
+		os.Exit(1)
+	}
+	if shortcut != "" {
+		base, args, err := shortcutCommand(shortcut, shortcutValues[shortcut])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		*command, *commandArgs = base, args
+	}
+
+	// The script argument is replaced by -script-file, -script-name or -command when given
+	scriptArgs := 1
+	if *scriptFile != "" || *scriptName != "" || *command != "" || perPlatform || *commandsFile != "" || *commandStringPath != "" {
+		scriptArgs = 0
+	}
+
+	// Read the command string up front so a bad path fails before authenticating
+	var commandString string
+	if *commandStringPath != "" {
+		if *scriptFile != "" || *scriptName != "" || *command != "" || perPlatform || *commandsFile != "" {
+			fmt.Println("Error: -command-string cannot be combined with other commands or scripts")
+			os.Exit(1)
+		}
+		commandString, err = readScriptFile(*commandStringPath)
+		if err == nil && strings.TrimSpace(commandString) == "" {
+			err = fmt.Errorf("%s is empty", *commandStringPath)
+		}
+		if err != nil {
+			fmt.Printf("Error: reading command string: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Read the command sequence up front so a bad path fails before authenticating
+	var fileCommands []string
+	if *commandsFile != "" {
+		if *scriptFile != "" || *scriptName != "" || *command != "" || perPlatform {
+			fmt.Println("Error: -commands-file cannot be combined with other commands or scripts")
+			os.Exit(1)
+		}
+		fileCommands, err = readListFile(*commandsFile)
+		if err == nil && len(fileCommands) == 0 {
+			err = fmt.Errorf("%s contains no commands", *commandsFile)
+		}
+		if err != nil {
+			fmt.Printf("Error: reading commands: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Read the script up front so a bad path fails before authenticating
+	script := flag.Arg(criteriaArgs)
+	if *scriptFile != "" {
+		if *scriptName != "" || *command != "" {
+			fmt.Println("Error: -script-file cannot be combined with -script-name or -command")
+			os.Exit(1)
+		}
+		script, err = readScriptFile(*scriptFile)
+		if err != nil {
+			fmt.Printf("Error: reading script: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Listing subcommands need no arguments and a dry run only needs the host criteria
+	listing := *listScripts || *listSessions || *deleteSession != "" || *check || *interactive
+	if !listing && flag.NArg() < criteriaArgs+scriptArgs && !(*dryRun && flag.NArg() == criteriaArgs) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	criteriaField, ok := rtr.SelectByFields[*selectBy]
+	if !ok {
+		fmt.Printf("Error: unknown -select-by value %q\n", *selectBy)
+		os.Exit(1)
+	}
+
+	if *workers < 1 {
+		fmt.Println("Error: -workers must be at least 1")
+		os.Exit(1)
+	}
+
+	if *batchSize < 1 {
+		fmt.Println("Error: -batch-size must be at least 1")
+		os.Exit(1)
+	}
+
+	if *timeout <= 0 {
+		fmt.Println("Error: -timeout must be greater than zero")
+		os.Exit(1)
+	}
+
+	if err := rtr.CheckBatchTimeout("-host-timeout", *hostTimeout); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *deadline < 0 {
+		fmt.Println("Error: -deadline must not be negative")
+		os.Exit(1)
+	}
+
+	if (explicit["interval"] || *reresolve) && !*repeat {
+		fmt.Println("Error: -interval and -reresolve require -repeat")
+		os.Exit(1)
+	}
+	if *statePath != "" && *repeat {
+		fmt.Println("Error: -state-file cannot be used with -repeat")
+		os.Exit(1)
+	}
+	if *interval <= 0 {
+		fmt.Println("Error: -interval must be greater than zero")
+		os.Exit(1)
+	}
+
+	// outputFilter decides which results are printed; nil prints them all
+	var outputFilter func(rtr.HostResult) bool
+	if *match != "" && *noMatch != "" {
+		fmt.Println("Error: -match and -no-match are mutually exclusive")
+		os.Exit(1)
+	}
+	if (*match != "" || *noMatch != "" || *failuresOnly || *getFile != "") && *raw {
+		fmt.Println("Error: -match, -no-match, -failures-only and -get-file cannot be used with -raw")
+		os.Exit(1)
+	}
+	if pattern := *match + *noMatch; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Printf("Error: invalid output pattern: %v\n", err)
+			os.Exit(1)
+		}
+		want := *match != ""
+		outputFilter = func(result rtr.HostResult) bool {
+			return re.MatchString(result.Stdout) == want
+		}
+	}
+
+	// Parse the result template up front so a mistake fails before anything runs
+	var resultTemplate *template.Template
+	if *templateText != "" {
+		if *output != "text" || *raw {
+			fmt.Println("Error: -template cannot be combined with -raw or -output json/csv")
+			os.Exit(1)
+		}
+		resultTemplate, err = parseResultTemplate(*templateText)
+		if err != nil {
+			fmt.Printf("Error: invalid -template: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *sortBy != "none" && *sortBy != "host" && *sortBy != "hostname" {
+		fmt.Printf("Error: unknown -sort value %q (expected host, hostname or none)\n", *sortBy)
+		os.Exit(1)
+	}
+
+	if (*clientCert == "") != (*clientKey == "") {
+		fmt.Println("Error: -client-cert and -client-key must be given together")
+		os.Exit(1)
+	}
+
+	if *output != "text" && *output != "json" && *output != "csv" {
+		fmt.Printf("Error: unknown output format %q (expected text, json or csv)\n", *output)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(*logLevel, *logJSON)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	// A profile supplies credentials and region unless they are given as flags
+	var profile credentialProfile
+	if *profileName != "" {
+		loaded, err := loadProfile(defaultProfilesPath(), *profileName)
+		if err != nil {
+			fmt.Printf("Error: loading profile: %v\n", err)
+			os.Exit(1)
+		}
+		profile = *loaded
+		if profile.Region != "" && !explicit["region"] {
+			*region = profile.Region
+		}
+	}
+
+	// Load environment variables from .env file; malformed lines are reported by number only
+	// since they may hold a secret
+	malformed, err := loadEnvFile(".env")
+	if err != nil {
+		logger.Warn("could not load .env file", "error", err)
+	}
+	for _, line := range malformed {
+		if *strictEnv {
+			fmt.Printf("Error: .env line %d is not a valid KEY=VALUE assignment\n", line)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: ignoring .env line %d, which is not a valid KEY=VALUE assignment\n", line)
+	}
+
+	apiURL := resolveSetting(*baseURL, "CS_BASE_URL")
+	if apiURL == "" {
+		apiURL, err = rtr.RegionBaseURL(*region)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	credentials := envCredentials{clientID: *clientIDFlag, clientSecret: *clientSecretFlag}
+	if credentials.clientID == "" && credentials.clientSecret == "" {
+		credentials = envCredentials{clientID: profile.ClientID, clientSecret: profile.ClientSecret}
+	}
+	if _, _, err := credentials.Credentials(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Cancel all in-flight requests on Ctrl-C or termination; open sessions are closed before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	clientOpts := []rtr.Option{rtr.WithCredentialProvider(credentials), rtr.WithBaseURL(apiURL), rtr.WithTimeout(*timeout)}
+	if *clientCert != "" {
+		clientOpts = append(clientOpts, rtr.WithClientCertificate(*clientCert, *clientKey))
+	}
+	rtrClient, err := rtr.NewRTRClientWithOptions("", "", clientOpts...)
+	if err != nil {
+		logger.Error("could not create client", "error", err)
+		os.Exit(1)
+	}
+	rtrClient.Logger = logger
+	rtrClient.SetRateLimit(*rateLimit)
+	rtrClient.QueueOffline = *queueOffline
+	rtrClient.IncludeHidden = *includeHidden
+	if authURL := resolveSetting(*authURLFlag, "CS_AUTH_URL"); authURL != "" {
+		rtrClient.SetAuthURL(authURL)
+	}
+	if *memberCID != "" {
+		if err := rtrClient.SetMemberCID(*memberCID); err != nil {
+			logger.Error("invalid member CID", "error", err)
+			os.Exit(1)
+		}
+	}
+	var hostFields []string
+	if *fields != "" {
+		hostFields = strings.Split(*fields, ",")
+		for i := range hostFields {
+			hostFields[i] = strings.TrimSpace(hostFields[i])
+		}
+		// Results are labelled by hostname and per-platform scripts need the platform
+		if err := rtrClient.SetHostFields(append([]string{"hostname", "platform_name"}, hostFields...)); err != nil {
+			logger.Error("invalid -fields", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *cacheToken {
+		rtrClient.SetTokenCache(rtr.DefaultTokenCachePath())
+	}
+	if *proxy != "" {
+		if err := rtrClient.SetProxy(*proxy); err != nil {
+			logger.Error("invalid proxy", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *check {
+		if err := rtrClient.Ping(ctx); err != nil {
+			fmt.Printf("FAILED: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("OK: %s (region %s)\n", apiURL, rtr.RegionForURL(apiURL))
+		return
+	}
+
+	if err := rtrClient.AuthenticateContext(ctx); err != nil {
+		logger.Error("authentication failed", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("authenticated", "base_url", apiURL)
+
+	if *listScripts {
+		scripts, err := rtrClient.ListScriptsContext(ctx)
+		if err != nil {
+			logger.Error("listing scripts failed", "error", err)
+			os.Exit(1)
+		}
+		printScripts(scripts)
+		return
+	}
+
+	if *listSessions {
+		sessions, err := rtrClient.ListSessionsContext(ctx)
+		if err != nil {
+			logger.Error("listing sessions failed", "error", err)
+			os.Exit(1)
+		}
+		printSessions(sessions)
+		return
+	}
+
+	if *deleteSession != "" {
+		err := rtrClient.DeleteSessionContext(ctx, *deleteSession)
+		switch {
+		case errors.Is(err, rtr.ErrSessionNotFound):
+			// Already gone is the outcome cleanup scripts want, so it is not a failure
+			fmt.Printf("Session %s not found; it was already closed or has expired\n", *deleteSession)
+		case err != nil:
+			logger.Error("deleting session failed", "error", err)
+			os.Exit(1)
+		default:
+			fmt.Printf("Deleted session %s\n", *deleteSession)
+		}
+		return
+	}
+
+	// selection records how targets were chosen for the run manifest
+	selection := runSelection{Source: "criteria"}
+	if len(aidHosts) > 0 {
+		selection.Source = "aid"
+	} else if *hostsFile != "" {
+		selection = runSelection{Source: "hosts_file", HostsFile: *hostsFile, Filter: hostClause}
+	} else if *rawFilter != "" {
+		selection = runSelection{Source: "filter", Filter: rtr.JoinFilters(*rawFilter, hostClause)}
+	} else {
+		selection.Filter = rtr.JoinFilters(rtr.CriteriaFilter(criteriaField, flag.Arg(0)), hostClause)
+	}
+
+	// resolveHosts finds the targets for the selection; -reresolve repeats it before each run
+	resolveHosts := func() ([]string, map[string]rtr.HostInfo, error) {
+		var hosts, hostnames []string
+		var err error
+		switch selection.Source {
+		case "aid":
+			hosts = aidHosts
+		case "hosts_file":
+			hosts, hostnames, err = hostsFromFile(ctx, rtrClient, *hostsFile, *hostsAreIDs, hostClause)
+		default:
+			hosts, err = rtrClient.HostSearchContext(ctx, "", "", selection.Filter, 0)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Info("hosts matched", "count", len(hosts))
+
+		// Hostnames make results keyed by agent ID readable; the run continues without them
+		details, err := rtrClient.GetHostDetailsContext(ctx, hosts)
+		if err != nil {
+			logger.Warn("could not look up host details", "error", err)
+		} else if missing := unresolvedHostnames(hostnames, details); len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d hostname(s) in %s matched no host: %s\n", len(missing), *hostsFile, strings.Join(missing, ", "))
+		}
+		return hosts, details, nil
+	}
+
+	hosts, details, err := resolveHosts()
+	if err != nil {
+		logger.Error("host search failed", "error", err)
+		os.Exit(1)
+	}
+	if len(hosts) == 0 {
+		fmt.Fprintf(os.Stderr, "No hosts matched %s\n", selection.describe())
+		os.Exit(noHostsExitCode)
+	}
+
+	// Resuming with a state file leaves out the hosts an earlier run completed
+	if *statePath != "" {
+		done, err := readStateFile(*statePath)
+		if err != nil {
+			logger.Error("could not read state file", "error", err)
+			os.Exit(1)
+		}
+		var remaining []string
+		for _, host := range hosts {
+			if !done[host] {
+				remaining = append(remaining, host)
+			}
+		}
+		if skipped := len(hosts) - len(remaining); skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Skipping %d host(s) already completed according to %s\n", skipped, *statePath)
+		}
+		if len(remaining) == 0 {
+			fmt.Fprintln(os.Stderr, "Every matched host has already completed")
+			return
+		}
+		hosts = remaining
+	}
+
+	if *dryRun {
+		printDryRun(hosts, details, hostFields)
+		return
+	}
+
+	if *interactive {
+		err := runInteractive(ctx, rtrClient, hosts[0], os.Stdin, os.Stdout)
+
+		cleanupCtx, cancelCleanup := context.WithTimeout(context.Background(), 30*time.Second)
+		if cerr := rtrClient.CloseActiveSessions(cleanupCtx); cerr != nil {
+			logger.Warn("session cleanup incomplete", "error", cerr)
+		}
+		cancelCleanup()
+
+		if err != nil && err != context.Canceled {
+			logger.Error("interactive session failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Run a command sequence, an explicit RTR command, a named cloud script or the raw script argument
+	var commands []string
+	switch {
+	case len(fileCommands) > 0:
+		commands = fileCommands
+	case commandString != "":
+		// Sent as read; the base command and tier come from its first word
+		commands = []string{commandString}
+	case *command != "":
+		commands = []string{strings.TrimSpace(*command + " " + *commandArgs)}
+	case *scriptName != "":
+		cmd, err := cloudScriptCommand(*scriptName)
+		if err != nil {
+			logger.Error("invalid script name", "error", err)
+			os.Exit(1)
+		}
+		commands = []string{cmd}
+	case perPlatform:
+		// Each platform's script becomes its own job below; commands is only used for the checks
+		for platform, platformScript := range platformScripts {
+			if platformScript == "" {
+				continue
+			}
+			platformCmd, err := rawScriptCommand(platformScript)
+			if err != nil {
+				logger.Error("invalid script", "platform", platform, "error", err)
+				os.Exit(1)
+			}
+			platformScripts[platform] = platformCmd
+			commands = append(commands, platformCmd)
+		}
+	default:
+		cmd, err := rawScriptCommand(script)
+		if err != nil {
+			logger.Error("invalid script", "error", err)
+			os.Exit(1)
+		}
+		commands = []string{cmd}
+	}
+
+	// planTargets returns the hosts that run commands and their batches. Every host runs
+	// commands unless scripts were given per platform
+	planTargets := func(hosts []string, details map[string]rtr.HostInfo) ([]string, []batchJob, error) {
+		if !perPlatform {
+			return hosts, planJobs(hosts, *batchSize, commands), nil
+		}
+		if details == nil {
+			return nil, nil, fmt.Errorf("per-platform scripts need host details, which could not be looked up")
+		}
+		groups, unmatched := groupByPlatform(hosts, details, platformScripts)
+		for _, host := range unmatched {
+			fmt.Fprintf(os.Stderr, "Skipping host %s: no script for platform %q\n",
+				rtr.HostResult{HostID: host, Hostname: details[host].Hostname}.Label(), details[host].PlatformName)
+		}
+		var targets []string
+		var jobs []batchJob
+		for platform, group := range groups {
+			targets = append(targets, group...)
+			jobs = append(jobs, planJobs(group, *batchSize, []string{platformScripts[platform]})...)
+		}
+		return targets, jobs, nil
+	}
+
+	targets, jobs, err := planTargets(hosts, details)
+	if err != nil {
+		logger.Error("could not plan batches", "error", err)
+		os.Exit(1)
+	}
+
+	var requiredScopes []string
+	for _, cmd := range commands {
+		tier, err := rtr.CommandTier(baseCommand(cmd), cmd)
+		if err != nil {
+			logger.Error("invalid command", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("running command", "base_command", baseCommand(cmd), "tier", tier)
+		requiredScopes = append(requiredScopes, rtr.RequiredScopes(cmd)...)
+	}
+
+	// Fail before opening any sessions when the token cannot run these commands
+	if missing, known := rtrClient.MissingScopes(requiredScopes); !known {
+		logger.Debug("token response did not list scopes, skipping scope preflight")
+	} else if len(missing) > 0 {
+		logger.Error("API client is missing required scopes", "missing", strings.Join(missing, ", "))
+		os.Exit(1)
+	}
+
+	if err := confirmTargets(len(targets), *maxHosts, *assumeYes, os.Stdin, os.Stderr); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// With -get-file the output directory holds the retrieved files and results go to the console
+	resultDir := *outputDir
+	if *getFile != "" {
+		resultDir = ""
+	}
+	out := &resultWriter{format: *output, dir: resultDir, tmpl: resultTemplate}
+	if *outputDir != "" {
+		if err := os.MkdirAll(*outputDir, 0755); err != nil {
+			logger.Error("could not create output directory", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var audit *auditLog
+	if *auditFile != "" {
+		if *operator == "" {
+			*operator = defaultOperator()
+		}
+		audit, err = openAuditLog(*auditFile, *operator)
+		if err != nil {
+			logger.Error("could not open audit file", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var state *stateFile
+	if *statePath != "" {
+		state, err = openStateFile(*statePath)
+		if err != nil {
+			logger.Error("could not open state file", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Hosts that complete while their batch is still polling are reported right away
+	stream := &hostStream{}
+	rtrClient.OnHostResult = stream.deliver
+
+	// Each iteration is one run; -repeat keeps iterating every -interval until interrupted
+	startedAt := time.Now().UTC()
+	var summary *runSummary
+	for iteration := 1; ; iteration++ {
+		// runCtx is cancelled early by -fail-fast on the first failing host or when -deadline passes
+		var runCtx context.Context
+		var cancelRun context.CancelFunc
+		if *deadline > 0 {
+			runCtx, cancelRun = context.WithTimeout(ctx, *deadline)
+		} else {
+			runCtx, cancelRun = context.WithCancel(ctx)
+		}
+
+		if *repeat {
+			out.header(fmt.Sprintf("=== Run %d at %s ===", iteration, time.Now().Format(time.RFC3339)))
+		}
+		summary = &runSummary{Total: len(hosts)}
+		// sorted buffers results for -sort until the run ends
+		var sorted []rtr.HostResult
+		bar := newProgress(len(targets), *quiet)
+		out.bar = bar
+		// reported holds the hosts already reported, since streamed hosts come back again with
+		// the rest of their batch
+		reported := make(map[string]bool, len(targets))
+		// report records, writes and audits the results of a finished batch or of hosts streamed
+		// ahead of it; collectResults calls it from a single goroutine
+		report := func(outcome batchOutcome) {
+			job := outcome.job
+			count := 0
+			for _, result := range outcome.results {
+				if reported[result.HostID] {
+					continue
+				}
+				reported[result.HostID] = true
+				count++
+
+				result.Hostname = details[result.HostID].Hostname
+				summary.add(result)
+				switch {
+				case *failuresOnly && !result.Failed() && !result.Offline:
+					summary.hideSuccess()
+				case outputFilter != nil && !outputFilter(result):
+					summary.suppress()
+				case *raw:
+					// The batch responses were printed as they arrived
+				case *sortBy != "none":
+					sorted = append(sorted, result)
+				default:
+					out.write(result)
+				}
+				if audit != nil {
+					if err := audit.record(result, job.baseCmd(), job.cmd()); err != nil {
+						logger.Error("could not write audit record", "host", result.HostID, "error", err)
+					}
+				}
+				if state != nil {
+					if err := state.record(result); err != nil {
+						logger.Error("could not write state file", "host", result.HostID, "error", err)
+					}
+				}
+				if *failFast && (result.Failed() || result.Offline) {
+					logger.Warn("aborting run after host failure", "host", result.HostID)
+					cancelRun()
+				}
+			}
+			bar.add(count)
+		}
+
+		collectResults(jobs, *workers, *workers, func(job batchJob, emit func([]rtr.HostResult)) []rtr.HostResult {
+			// Batches the deadline kept from starting count as timed out; after -fail-fast or an
+			// interrupt the remaining batches are skipped
+			if err := runCtx.Err(); err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					return failedResults(job.hosts, errors.New("deadline exceeded"))
+				}
+				return nil
+			}
+			logger.Info("running batch", "hosts", len(job.hosts))
+			// Only a single command has a host's final result when the host completes
+			if len(job.commands) == 1 && *getFile == "" {
+				stream.register(job.hosts, emit)
+				defer stream.unregister(job.hosts)
+			}
+			var onResponse func([]byte)
+			if *raw {
+				onResponse = out.writeRaw
+			}
+			var results []rtr.HostResult
+			var err error
+			if *getFile != "" {
+				results, err = runGetFile(runCtx, rtrClient, job.hosts, *getFile, *outputDir, *hostTimeout)
+			} else {
+				results, err = runcmd(runCtx, rtrClient, job.hosts, job.commands, *hostTimeout, *continueOnError, onResponse)
+			}
+			if err != nil {
+				logger.Error("batch failed", "hosts", len(job.hosts), "error", err)
+				results = failedResults(job.hosts, err)
+			}
+			return results
+		}, func(job batchJob, recovered interface{}) []rtr.HostResult {
+			logger.Error("batch panicked", "hosts", len(job.hosts), "panic", recovered)
+			return failedResults(job.hosts, fmt.Errorf("internal error: %v", recovered))
+		}, report)
+
+		bar.finish()
+		if len(sorted) > 0 {
+			sortResults(sorted, *sortBy)
+			for _, result := range sorted {
+				out.write(result)
+			}
+		}
+
+		// Close any sessions left open by an interrupted or aborted run
+		cleanupCtx, cancelCleanup := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := rtrClient.CloseActiveSessions(cleanupCtx); err != nil {
+			logger.Warn("session cleanup incomplete", "error", err)
+		}
+		cancelCleanup()
+
+		summary.print(*summaryJSON)
+		cancelRun()
+
+		if !*repeat {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(*interval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if *reresolve {
+			// A failed search keeps the previous targets so monitoring carries on
+			newHosts, newDetails, err := resolveHosts()
+			if err == nil {
+				var newTargets []string
+				var newJobs []batchJob
+				if newTargets, newJobs, err = planTargets(newHosts, newDetails); err == nil {
+					hosts, details, targets, jobs = newHosts, newDetails, newTargets, newJobs
+				}
+			}
+			if err != nil {
+				logger.Warn("could not re-resolve hosts, reusing the previous targets", "error", err)
+			}
+		}
+	}
+
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			logger.Error("could not close audit file", "error", err)
+		}
+	}
+	if state != nil {
+		if err := state.Close(); err != nil {
+			logger.Error("could not close state file", "error", err)
+		}
+	}
+
+	if *manifestPath != "" {
+		manifest := runManifest{
+			Version:    version,
+			StartedAt:  startedAt,
+			FinishedAt: time.Now().UTC(),
+			Selection:  selection,
+			Hosts:      targets,
+			Commands:   manifestCommands(jobs),
+			Summary:    summary,
+		}
+		if err := manifest.write(*manifestPath); err != nil {
+			logger.Error("could not write run manifest", "error", err)
+		}
+	}
+
+	if *metricsFile != "" {
+		if err := writeMetrics(*metricsFile, rtrClient.Stats(), summary, time.Since(startedAt)); err != nil {
+			logger.Error("could not write metrics file", "error", err)
+		}
+	}
+
+	if code := summary.exitCode(*failExitCode); code != 0 {
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,2610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"crowdstrike-cli/pkg/rtr"
+)
+
+// runMainEnv makes the test binary run main with its arguments instead of the tests, so the
+// CLI can be exercised end to end in a subprocess
+const runMainEnv = "CROWDSTRIKE_CLI_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeCrowdStrike serves the API endpoints a CLI run uses. Every search matches all of its
+// hosts, every host opens a session and every command completes with "ran <command>" as
+// output, unless a handler registered for "METHOD path" answers instead
+type fakeCrowdStrike struct {
+	t     *testing.T
+	URL   string
+	hosts []string
+
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	requests []fakeRequest
+}
+
+// fakeRequest is a request received by fakeCrowdStrike
+type fakeRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Body   []byte
+}
+
+const rtrPath = "/real-time-response"
+
+func newFakeCrowdStrike(t *testing.T, hosts ...string) *fakeCrowdStrike {
+	f := &fakeCrowdStrike{t: t, hosts: hosts, handlers: make(map[string]http.HandlerFunc)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.URL = srv.URL
+	return f
+}
+
+// handle registers h for a route such as "POST /real-time-response/combined/batch-command/v1"
+func (f *fakeCrowdStrike) handle(route string, h http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handlers[route] = h
+}
+
+// recorded returns the requests whose path starts with prefix
+func (f *fakeCrowdStrike) recorded(method, prefix string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var requests []fakeRequest
+	for _, req := range f.requests {
+		if req.Method == method && strings.HasPrefix(req.Path, prefix) {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func (f *fakeCrowdStrike) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	f.mu.Lock()
+	f.requests = append(f.requests, fakeRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: body})
+	h := f.handlers[r.Method+" "+r.URL.Path]
+	f.mu.Unlock()
+
+	if h != nil {
+		h(w, r)
+		return
+	}
+
+	switch route := r.Method + " " + r.URL.Path; route {
+	case "POST /oauth2/token":
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"access_token": "test-token", "token_type": "bearer", "expires_in": 1800})
+	case "GET /devices/queries/devices-scroll/v1":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"meta":      map[string]interface{}{"pagination": map[string]interface{}{"total": len(f.hosts)}},
+			"resources": f.hosts,
+		})
+	case "GET /devices/entities/devices/v2":
+		var devices []map[string]interface{}
+		for _, id := range r.URL.Query()["ids"] {
+			devices = append(devices, map[string]interface{}{"device_id": id, "hostname": "name-" + id, "platform_name": "Windows"})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": devices})
+	case "POST " + rtrPath + "/combined/batch-init-session/v1":
+		var payload struct {
+			HostIDs []string `json:"host_ids"`
+		}
+		json.Unmarshal(body, &payload)
+		sessions := make(map[string]interface{})
+		for _, host := range payload.HostIDs {
+			sessions[host] = map[string]interface{}{"session_id": "session-" + host}
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"batch_id": "batch-1", "resources": sessions})
+	case "POST " + rtrPath + "/combined/batch-command/v1",
+		"POST " + rtrPath + "/combined/batch-active-responder-command/v1",
+		"POST " + rtrPath + "/combined/batch-admin-command/v1":
+		var payload struct {
+			CommandString string   `json:"command_string"`
+			OptionalHosts []string `json:"optional_hosts"`
+		}
+		json.Unmarshal(body, &payload)
+		results := make(map[string]interface{})
+		for _, host := range payload.OptionalHosts {
+			results[host] = map[string]interface{}{"complete": true, "stdout": "ran " + payload.CommandString}
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": results}})
+	case "POST " + rtrPath + "/combined/batch-refresh-session/v1":
+		writeJSON(w, http.StatusCreated, map[string]interface{}{})
+	case "DELETE " + rtrPath + "/entities/sessions/v1":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.t.Errorf("unexpected request %s", route)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// newTestClient returns a client for api that does not retry and discards its logs
+func newTestClient(t *testing.T, api *fakeCrowdStrike) *rtr.RTRClient {
+	t.Helper()
+
+	c, err := rtr.NewRTRClientWithOptions("test-id", "test-secret", rtr.WithBaseURL(api.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaxRetries = 0
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return c
+}
+
+// cliCommand returns a command running the CLI against api from a fresh working and home
+// directory, with credentials in the environment
+func cliCommand(t *testing.T, api *fakeCrowdStrike, args ...string) *exec.Cmd {
+	t.Helper()
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], append([]string{"-base-url", api.URL}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "HOME="+dir, "CLIENT_ID=test-id", "CLIENT_SECRET=test-secret", "CS_AUTH_URL=", "CS_BASE_URL=")
+	return cmd
+}
+
+// runCLI runs the CLI against api and returns its output and exit code
+func runCLI(t *testing.T, api *fakeCrowdStrike, args ...string) (string, string, int) {
+	t.Helper()
+
+	return runCommand(t, cliCommand(t, api, args...))
+}
+
+// runCommand runs a command from cliCommand and returns its output and exit code
+func runCommand(t *testing.T, cmd *exec.Cmd) (string, string, int) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatal(err)
+		}
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// writeTempFile writes content to name in a new temporary directory and returns its path
+func writeTempFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// captureOutput runs fn with os.Stdout and os.Stderr redirected to files and returns what
+// it wrote to each
+func captureOutput(t *testing.T, fn func()) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+
+	origStdout, origStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	defer func() { os.Stdout, os.Stderr = origStdout, origStderr }()
+	fn()
+
+	out, _ := os.ReadFile(stdout.Name())
+	errOut, _ := os.ReadFile(stderr.Name())
+	return string(out), string(errOut)
+}
+
+// unsetEnv unsets key for the rest of the test
+func unsetEnv(t *testing.T, key string) {
+	t.Helper()
+
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestCredentialPrecedence(t *testing.T) {
+	t.Setenv("CLIENT_ID", "env-id")
+	unsetEnv(t, "CLIENT_SECRET")
+
+	envPath := writeTempFile(t, ".env", "CLIENT_ID=file-id\nCLIENT_SECRET=file-secret\n")
+	if _, err := loadEnvFile(envPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment wins over .env, which fills in what the environment lacks
+	id, secret, err := envCredentials{}.Credentials()
+	if err != nil || id != "env-id" || secret != "file-secret" {
+		t.Errorf("without flags = %q, %q, %v, want env-id, file-secret", id, secret, err)
+	}
+
+	// Flags win over both
+	id, secret, err = envCredentials{clientID: "flag-id", clientSecret: "flag-secret"}.Credentials()
+	if err != nil || id != "flag-id" || secret != "flag-secret" {
+		t.Errorf("with flags = %q, %q, %v, want flag-id, flag-secret", id, secret, err)
+	}
+
+	unsetEnv(t, "CLIENT_ID")
+	unsetEnv(t, "CLIENT_SECRET")
+	if _, _, err := (envCredentials{}).Credentials(); err == nil {
+		t.Error("Credentials succeeded with no credentials anywhere")
+	}
+}
+
+func TestResultWriterJSONLines(t *testing.T) {
+	w := &resultWriter{format: "json"}
+	stdout, _ := captureOutput(t, func() {
+		w.write(rtr.HostResult{HostID: "host-1", Stdout: "a \"quoted\"\nline", Complete: true})
+		w.write(rtr.HostResult{HostID: "host-2", Stderr: "denied", Complete: true})
+	})
+
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want one per host:\n%s", len(lines), stdout)
+	}
+	// exit_code is derived, so it is decoded alongside the result's own fields
+	var first, second struct {
+		rtr.HostResult
+		ExitCode int `json:"exit_code"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	if first.HostID != "host-1" || first.Stdout != "a \"quoted\"\nline" || first.ExitCode != 0 {
+		t.Errorf("first line = %+v", first)
+	}
+	if second.HostID != "host-2" || second.Stderr != "denied" || second.ExitCode != 1 {
+		t.Errorf("second line = %+v", second)
+	}
+}
+
+func TestRunAllLimitsConcurrency(t *testing.T) {
+	const workers = 3
+	batches := make([]int, 20)
+	var mu sync.Mutex
+	running, peak, done := 0, 0, 0
+
+	runAll(batches, workers, func(int) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		done++
+		mu.Unlock()
+	}, func(int, interface{}) {})
+
+	if peak > workers {
+		t.Errorf("%d batches ran at once, want at most %d", peak, workers)
+	}
+	if done != len(batches) {
+		t.Errorf("%d batches ran, want %d", done, len(batches))
+	}
+}
+
+func TestCollectResults(t *testing.T) {
+	var hosts []string
+	for i := 0; i < 50; i++ {
+		hosts = append(hosts, fmt.Sprintf("host-%02d", i))
+	}
+	jobs := planJobs(hosts, 5, []string{"ps"})
+
+	var mu sync.Mutex
+	handling := false
+	seen := make(map[string]int)
+	collectResults(jobs, 4, 2, func(job batchJob, emit func([]rtr.HostResult)) []rtr.HostResult {
+		var results []rtr.HostResult
+		for _, host := range job.hosts {
+			results = append(results, rtr.HostResult{HostID: host, Complete: true})
+		}
+		switch job.hosts[0] {
+		case "host-10":
+			panic("unexpected response")
+		case "host-20":
+			// Everything was streamed already
+			emit(results)
+			return nil
+		case "host-30":
+			// The first host finished early
+			emit(results[:1])
+			return results[1:]
+		}
+		time.Sleep(time.Millisecond)
+		return results
+	}, func(job batchJob, recovered interface{}) []rtr.HostResult {
+		var results []rtr.HostResult
+		for _, host := range job.hosts {
+			results = append(results, rtr.HostResult{HostID: host, ErrorMessage: fmt.Sprint(recovered)})
+		}
+		return results
+	}, func(outcome batchOutcome) {
+		mu.Lock()
+		if handling {
+			t.Error("handle called concurrently")
+		}
+		handling = true
+		mu.Unlock()
+
+		for _, result := range outcome.results {
+			if !strings.Contains(strings.Join(outcome.job.hosts, ","), result.HostID) {
+				t.Errorf("result for %s reported with the batch of %s", result.HostID, outcome.job.hosts[0])
+			}
+			seen[result.HostID]++
+		}
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		handling = false
+		mu.Unlock()
+	})
+
+	for _, host := range hosts {
+		if seen[host] != 1 {
+			t.Errorf("%s reported %d times, want once", host, seen[host])
+		}
+	}
+	if len(seen) != len(hosts) {
+		t.Errorf("%d hosts reported, want %d", len(seen), len(hosts))
+	}
+}
+
+func TestHostStream(t *testing.T) {
+	var stream hostStream
+	var got []string
+	emit := func(results []rtr.HostResult) {
+		for _, result := range results {
+			got = append(got, result.HostID)
+		}
+	}
+
+	stream.deliver(rtr.HostResult{HostID: "aaa"})
+	stream.register([]string{"aaa", "bbb"}, emit)
+	stream.deliver(rtr.HostResult{HostID: "aaa"})
+	stream.deliver(rtr.HostResult{HostID: "ccc"})
+	stream.unregister([]string{"aaa", "bbb"})
+	stream.deliver(rtr.HostResult{HostID: "bbb"})
+
+	if strings.Join(got, ",") != "aaa" {
+		t.Errorf("delivered %v, want only the registered host while registered", got)
+	}
+}
+
+func TestPlanJobs(t *testing.T) {
+	hosts := make([]string, 2501)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host-%d", i)
+	}
+	commands := []string{"ls"}
+
+	jobs := planJobs(hosts, 1000, commands)
+	if len(jobs) != 3 {
+		t.Fatalf("%d jobs, want ceil(2501/1000) = 3", len(jobs))
+	}
+	total := 0
+	for _, job := range jobs {
+		if len(job.hosts) > 1000 {
+			t.Errorf("job with %d hosts exceeds the batch size", len(job.hosts))
+		}
+		if job.cmd() != "ls" {
+			t.Errorf("job command = %q", job.cmd())
+		}
+		total += len(job.hosts)
+	}
+	if total != len(hosts) || jobs[2].hosts[0] != "host-2000" {
+		t.Errorf("jobs cover %d hosts starting the last at %s", total, jobs[2].hosts[0])
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	api := newFakeCrowdStrike(t, "aaa", "bbb")
+	stdout, stderr, code := runCLI(t, api, "-dry-run", "web-*")
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s%s", code, stdout, stderr)
+	}
+
+	for _, want := range []string{"aaa\tname-aaa\tWindows\n", "bbb\tname-bbb\tWindows\n", "Dry run: 2 host(s) matched, no commands were executed"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output is missing %q:\n%s", want, stdout)
+		}
+	}
+	if requests := api.recorded("POST", rtrPath); len(requests) != 0 {
+		t.Errorf("dry run sent RTR requests: %+v", requests)
+	}
+}
+
+func TestHostsFromFile(t *testing.T) {
+	path := writeTempFile(t, "hosts.txt", "# targets\nweb-01\n\n  web-02  \r\n# done\n")
+	entries, err := readListFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(entries, ",") != "web-01,web-02" {
+		t.Errorf("readListFile = %q", entries)
+	}
+
+	api := newFakeCrowdStrike(t, "aaa", "bbb")
+	c := newTestClient(t, api)
+
+	// Agent IDs are validated and normalized as for -aid, without a search
+	idPath := writeTempFile(t, "ids.txt", strings.ToUpper(testAID)+"\n")
+	hosts, names, err := hostsFromFile(context.Background(), c, idPath, true, "")
+	if err != nil || strings.Join(hosts, ",") != testAID || names != nil {
+		t.Errorf("as IDs = %q, %q, %v", hosts, names, err)
+	}
+	if _, _, err := hostsFromFile(context.Background(), c, path, true, ""); err == nil || !strings.Contains(err.Error(), `invalid agent ID "web-01"`) {
+		t.Errorf("hostnames read as IDs = %v", err)
+	}
+	if searches := api.recorded("GET", "/devices/queries"); len(searches) != 0 {
+		t.Errorf("agent IDs were searched for: %+v", searches)
+	}
+
+	// Hostnames are resolved through one search, narrowed by the filter
+	hosts, names, err = hostsFromFile(context.Background(), c, path, false, "platform_name:'Windows'")
+	if err != nil || strings.Join(hosts, ",") != "aaa,bbb" || strings.Join(names, ",") != "web-01,web-02" {
+		t.Errorf("as hostnames = %q, %q, %v", hosts, names, err)
+	}
+	searches := api.recorded("GET", "/devices/queries")
+	if len(searches) != 1 || !strings.Contains(searches[0].Query, url.QueryEscape("hostname:['web-01','web-02']+platform_name:'Windows'")) {
+		t.Errorf("searches = %+v", searches)
+	}
+}
+
+func TestUnresolvedHostnames(t *testing.T) {
+	details := map[string]rtr.HostInfo{
+		"aaa": {HostID: "aaa", Hostname: "WEB-01"},
+		"bbb": {HostID: "bbb", Hostname: "db-07"},
+	}
+	names := []string{"web-01", "web-02", "db-*", "mail-*"}
+	if got := unresolvedHostnames(names, details); strings.Join(got, ",") != "web-02,mail-*" {
+		t.Errorf("unresolved = %q, want web-02,mail-*", got)
+	}
+	if got := unresolvedHostnames(nil, details); len(got) != 0 {
+		t.Errorf("no names = %q", got)
+	}
+
+	// The run goes ahead with the hosts that did resolve
+	api := newFakeCrowdStrike(t, "aaa")
+	cmd := cliCommand(t, api, "-hosts-file", writeTempFile(t, "hosts.txt", "name-aaa\nghost-01\n"), "-command", "ps")
+	stdout, stderr, code := runCommand(t, cmd)
+	if code != 0 || !strings.Contains(stdout, "ran ps") {
+		t.Fatalf("exit code %d: %s%s", code, stdout, stderr)
+	}
+	if !strings.Contains(stderr, "Warning: 1 hostname(s) in ") || !strings.Contains(stderr, "matched no host: ghost-01\n") {
+		t.Errorf("stderr is missing the unresolved hostname warning:\n%s", stderr)
+	}
+}
+
+func TestRawFilter(t *testing.T) {
+	const filter = "platform_name:'Linux'+tags:'SensorGroupingTags/prod'"
+	api := newFakeCrowdStrike(t, "aaa")
+	if _, stderr, code := runCLI(t, api, "-dry-run", "-filter", filter); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	searches := api.recorded("GET", "/devices/queries/devices-scroll/v1")
+	if len(searches) != 1 {
+		t.Fatalf("%d searches, want 1", len(searches))
+	}
+	query, _ := url.ParseQuery(searches[0].Query)
+	if got := query.Get("filter"); got != filter {
+		t.Errorf("filter = %q, want %q unchanged", got, filter)
+	}
+
+	if stdout, _, code := runCLI(t, api, "-dry-run", "-filter", filter, "-select-by", "tag"); code != 1 || !strings.Contains(stdout, "mutually exclusive") {
+		t.Errorf("-filter with -select-by exited %d: %s", code, stdout)
+	}
+}
+
+func TestWriteResultFiles(t *testing.T) {
+	result := rtr.HostResult{HostID: "aaa", Stdout: "listing", Stderr: "warning", Complete: true}
+
+	dir := t.TempDir()
+	w := &resultWriter{format: "text", dir: dir}
+	w.write(result)
+	text, err := os.ReadFile(filepath.Join(dir, "aaa.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(text) != "listing\n--- stderr ---\nwarning\n" {
+		t.Errorf("aaa.txt = %q", text)
+	}
+
+	w = &resultWriter{format: "json", dir: dir}
+	w.write(result)
+	data, err := os.ReadFile(filepath.Join(dir, "aaa.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		rtr.HostResult
+		ExitCode int `json:"exit_code"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Stdout != "listing" || decoded.ExitCode != 1 {
+		t.Errorf("aaa.json = %+v", decoded)
+	}
+
+	// A host ID never escapes the output directory
+	w.write(rtr.HostResult{HostID: "../escape"})
+	if _, err := os.Stat(filepath.Join(dir, "escape.json")); err != nil {
+		t.Errorf("path-like host ID was not kept inside the directory: %v", err)
+	}
+}
+
+func TestCloudScriptCommand(t *testing.T) {
+	for name, want := range map[string]string{
+		"collect":             `runscript -CloudFile="collect"`,
+		`C:\tools\triage.ps1`: `runscript -CloudFile="C:\tools\triage.ps1"`,
+		"it's mine":           `runscript -CloudFile="it's mine"`,
+	} {
+		if got, err := cloudScriptCommand(name); err != nil || got != want {
+			t.Errorf("cloudScriptCommand(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	for _, name := range []string{"", "  ", `say "hi"`} {
+		if got, err := cloudScriptCommand(name); err == nil {
+			t.Errorf("cloudScriptCommand(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+// testAID is a well-formed agent ID for -aid
+const testAID = "0123456789abcdef0123456789abcdef"
+
+// sentCommand is a command posted to one of the batch command endpoints
+type sentCommand struct {
+	Endpoint      string
+	BaseCommand   string   `json:"base_command"`
+	CommandString string   `json:"command_string"`
+	OptionalHosts []string `json:"optional_hosts"`
+}
+
+// sentCommands returns the commands api received, in order
+func sentCommands(t *testing.T, api *fakeCrowdStrike) []sentCommand {
+	t.Helper()
+
+	var commands []sentCommand
+	for _, req := range api.recorded("POST", rtrPath+"/combined/batch-") {
+		if !strings.HasSuffix(req.Path, "command/v1") {
+			continue
+		}
+		command := sentCommand{Endpoint: strings.TrimPrefix(req.Path, rtrPath+"/combined/")}
+		if err := json.Unmarshal(req.Body, &command); err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+func TestBaseCommands(t *testing.T) {
+	for _, tc := range []struct {
+		args                []string
+		wantBase, wantWhole string
+	}{
+		{[]string{"-command", "ls", "-args", `C:\Windows`}, "ls", `ls C:\Windows`},
+		{[]string{"-command", "ps"}, "ps", "ps"},
+		{[]string{"-command", "reg", "-args", `query HKLM\Software\Run`}, "reg", `reg query HKLM\Software\Run`},
+		{[]string{"-list-dir", `C:\Program Files`}, "ls", `ls "C:\Program Files"`},
+	} {
+		api := newFakeCrowdStrike(t)
+		stdout, stderr, code := runCLI(t, api, append([]string{"-aid", testAID}, tc.args...)...)
+		if code != 0 {
+			t.Fatalf("%v exited %d:\n%s%s", tc.args, code, stdout, stderr)
+		}
+
+		commands := sentCommands(t, api)
+		if len(commands) != 1 || commands[0].BaseCommand != tc.wantBase || commands[0].CommandString != tc.wantWhole {
+			t.Errorf("%v sent %+v, want %s / %s", tc.args, commands, tc.wantBase, tc.wantWhole)
+		}
+		if !strings.Contains(stdout, "ran "+tc.wantWhole) {
+			t.Errorf("%v printed %q", tc.args, stdout)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	if cfg, err := loadConfig(missing, false); err != nil || len(cfg.Settings) != 0 {
+		t.Errorf("optional missing config = %v, %v", cfg, err)
+	}
+	if _, err := loadConfig(missing, true); err == nil {
+		t.Error("a required config that does not exist was accepted")
+	}
+	for name, content := range map[string]string{
+		"bad.json":      "{",
+		"nested.yaml":   "output:\n  format: json\n",
+		"orphan.yaml":   "- a\n",
+		"nokey.yaml":    "workers 4\n",
+		"dup.yaml":      "workers: 4\nworkers: 8\n",
+		"badlist.yaml":  "aid: [a, b\n",
+		"badquote.yaml": "aid: ['a, b]\n",
+	} {
+		if _, err := loadConfig(writeTempFile(t, name, content), false); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+
+	want := map[string][]string{"workers": {"4"}, "aid": {"a", "b"}, "log_json": {"true"}}
+	yaml := `# defaults
+workers: 4   # more than the default
+aid:
+  - a
+  - "b"
+log_json: true
+`
+	for name, content := range map[string]string{
+		"cfg.json":  `{"workers": 4, "aid": ["a", "b"], "log_json": true}`,
+		"cfg.yaml":  yaml,
+		"flow.yaml": "workers: '4'\naid: [a, \"b\"]\nlog_json: true\n",
+	} {
+		cfg, err := loadConfig(writeTempFile(t, name, content), true)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(cfg.Settings) != len(want) {
+			t.Errorf("%s settings = %q, want %q", name, cfg.Settings, want)
+		}
+		for key, values := range want {
+			if got := cfg.Settings[key]; strings.Join(got, ",") != strings.Join(values, ",") {
+				t.Errorf("%s %s = %q, want %q", name, key, got, values)
+			}
+		}
+	}
+
+	// Quotes keep commas, brackets and # in list items and scalars; null leaves a key unset
+	cfg, err := loadConfig(writeTempFile(t, "quoted.yaml", "aid: [\"a, b\", 'c]', d] # comment\nlog_file: \"x #1\"\nregion: ~\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Settings["aid"]; strings.Join(got, "|") != "a, b|c]|d" {
+		t.Errorf("aid = %q", got)
+	}
+	if got := cfg.Settings["log_file"]; len(got) != 1 || got[0] != "x #1" {
+		t.Errorf("log_file = %q", got)
+	}
+	if got, ok := cfg.Settings["region"]; !ok || len(got) != 0 {
+		t.Errorf("region = %q, %v, want present without values", got, ok)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	const otherAID = "fedcba9876543210fedcba9876543210"
+	config := "output: json\naid:\n  - " + testAID + "\n  - " + otherAID + "\nfail_exit_code: 5\n"
+
+	api := newFakeCrowdStrike(t)
+	// The file sets defaults for every flag, including repeatable ones
+	cmd := cliCommand(t, api, "-command", "ps")
+	if err := os.WriteFile(filepath.Join(cmd.Dir, ".crowdstrike-cli.yaml"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runCommand(t, cmd)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "{") {
+		t.Errorf("want JSON lines for both configured agent IDs, got:\n%s", stdout)
+	}
+
+	// Flags override the file
+	cmd = cliCommand(t, api, "-command", "ps", "-output", "text")
+	os.WriteFile(filepath.Join(cmd.Dir, ".crowdstrike-cli.yaml"), []byte(config), 0600)
+	if stdout, _, _ := runCommand(t, cmd); strings.Contains(stdout, "{") || !strings.Contains(stdout, "ran ps") {
+		t.Errorf("-output text did not override the file:\n%s", stdout)
+	}
+
+	// -config also takes a JSON file
+	cmd = cliCommand(t, api, "-command", "ps", "-config", writeTempFile(t, "cfg.json", `{"output": "json", "aid": ["`+testAID+`"]}`))
+	if stdout, stderr, code := runCommand(t, cmd); code != 0 || !strings.HasPrefix(stdout, "{") {
+		t.Errorf("JSON config exited %d: %s%s", code, stdout, stderr)
+	}
+
+	// Unknown keys are rejected
+	cmd = cliCommand(t, api, "-command", "ps", "-config", writeTempFile(t, "cfg.yaml", "colour: blue\nworkers: 2\n"))
+	if stdout, _, code := runCommand(t, cmd); code != 1 || !strings.Contains(stdout, "unknown config key(s): colour") {
+		t.Errorf("unknown key exited %d: %s", code, stdout)
+	}
+
+	// Values are checked by the flag they set
+	cmd = cliCommand(t, api, "-command", "ps", "-config", writeTempFile(t, "cfg.yaml", "workers: many\n"))
+	if stdout, _, code := runCommand(t, cmd); code != 1 || !strings.Contains(stdout, "invalid config value for workers") {
+		t.Errorf("invalid value exited %d: %s", code, stdout)
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	summary := &runSummary{Total: 5}
+	summary.add(rtr.HostResult{HostID: "ok", Complete: true})
+	summary.add(rtr.HostResult{HostID: "stderr", Complete: true, Stderr: "denied"})
+	summary.add(rtr.HostResult{HostID: "error", ErrorMessage: "timed out"})
+	summary.add(rtr.HostResult{HostID: "offline", Offline: true})
+
+	_, stderr := captureOutput(t, func() { summary.print(false) })
+	if want := "Summary: 5 targeted, 1 succeeded, 2 failed, 1 offline, 1 skipped\n"; stderr != want {
+		t.Errorf("summary = %q, want %q", stderr, want)
+	}
+
+	_, stderr = captureOutput(t, func() { summary.print(true) })
+	var decoded map[string]int
+	if err := json.Unmarshal([]byte(stderr), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"total": 5, "succeeded": 1, "failed": 2, "offline": 1, "skipped": 1}
+	for key, n := range want {
+		if decoded[key] != n {
+			t.Errorf("JSON summary %s = %d, want %d", key, decoded[key], n)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		result rtr.HostResult
+		want   int
+	}{
+		{rtr.HostResult{Complete: true, Stdout: "ok"}, 0},
+		{rtr.HostResult{Complete: true, Stderr: "denied"}, 7},
+		{rtr.HostResult{ErrorMessage: "timed out"}, 7},
+		{rtr.HostResult{Offline: true}, 7},
+	} {
+		summary := &runSummary{Total: 2}
+		summary.add(rtr.HostResult{Complete: true})
+		summary.add(tc.result)
+		if got := summary.exitCode(7); got != tc.want {
+			t.Errorf("exitCode with %+v = %d, want %d", tc.result, got, tc.want)
+		}
+	}
+
+	// End to end, a host writing to stderr fails the run
+	api := newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			testAID: map[string]interface{}{"complete": true, "stderr": "access denied"},
+		}}})
+	})
+	if _, _, code := runCLI(t, api, "-aid", testAID, "-command", "ps"); code != 1 {
+		t.Errorf("failed host exited %d, want 1", code)
+	}
+	if _, _, code := runCLI(t, api, "-aid", testAID, "-command", "ps", "-fail-exit-code", "9"); code != 9 {
+		t.Errorf("failed host with -fail-exit-code 9 exited %d", code)
+	}
+}
+
+func TestRuncmdKeepsQuotes(t *testing.T) {
+	const cmd = `cat "C:\notes\it's here.txt"`
+	api := newFakeCrowdStrike(t)
+	results, err := runcmd(context.Background(), newTestClient(t, api), []string{"aaa"}, []string{cmd}, 30*time.Second, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Stdout != "ran "+cmd {
+		t.Errorf("results = %+v, want stdout %q", results, "ran "+cmd)
+	}
+	if commands := sentCommands(t, api); len(commands) != 1 || commands[0].CommandString != cmd {
+		t.Errorf("sent %+v, want %q unchanged", commands, cmd)
+	}
+}
+
+func TestOfflineHosts(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	// "bbb" is left out of the response and "ccc" is queued for when it comes back online
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"complete": true, "stdout": "listing"},
+			"ccc": map[string]interface{}{"complete": false, "offline_queued": true},
+		}}})
+	})
+
+	results, err := runcmd(context.Background(), newTestClient(t, api), []string{"aaa", "bbb", "ccc"}, []string{"ls"}, 30*time.Second, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results, want one per host: %+v", len(results), results)
+	}
+	if r := results[0]; r.Offline || r.Stdout != "listing" || r.Failed() {
+		t.Errorf("online host = %+v", r)
+	}
+	for _, r := range results[1:] {
+		if !r.Offline || r.ErrorMessage != "" {
+			t.Errorf("host %s = %+v, want offline without an error", r.HostID, r)
+		}
+	}
+
+	w := &resultWriter{format: "text"}
+	stdout, _ := captureOutput(t, func() { w.write(results[1]) })
+	if !strings.Contains(strings.ToLower(stdout), "offline") {
+		t.Errorf("offline host printed %q", stdout)
+	}
+}
+
+func TestInterruptClosesSessions(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	c := newTestClient(t, api)
+
+	// A batch that finishes normally is released and left alone
+	if _, err := runcmd(context.Background(), c, []string{"done"}, []string{"ls"}, 30*time.Second, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	})
+	// An already expired session does not fail the cleanup
+	api.handle("DELETE "+rtrPath+"/entities/sessions/v1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("session_id") == "session-bbb" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if _, err := runcmd(ctx, c, []string{"aaa", "bbb"}, []string{"ls"}, 30*time.Second, false, nil); err == nil {
+		t.Fatal("interrupted batch succeeded")
+	}
+
+	if err := c.CloseActiveSessions(context.Background()); err != nil {
+		t.Errorf("CloseActiveSessions = %v", err)
+	}
+	var closed []string
+	for _, req := range api.recorded("DELETE", rtrPath+"/entities/sessions/v1") {
+		query, _ := url.ParseQuery(req.Query)
+		closed = append(closed, query.Get("session_id"))
+	}
+	sort.Strings(closed)
+	if strings.Join(closed, ",") != "session-aaa,session-bbb" {
+		t.Errorf("closed sessions %q, want those of the interrupted batch", closed)
+	}
+}
+
+func TestSeparateAuthURL(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	auth := newFakeCrowdStrike(t)
+	unused := newFakeCrowdStrike(t)
+
+	// CS_AUTH_URL moves the token request to its own host
+	cmd := cliCommand(t, api, "-aid", testAID, "-command", "ps")
+	cmd.Env = append(cmd.Env, "CS_AUTH_URL="+auth.URL)
+	if _, stderr, code := runCommand(t, cmd); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if got := len(auth.recorded("POST", "/oauth2/token")); got != 1 {
+		t.Errorf("%d token requests to the auth host, want 1", got)
+	}
+	if got := len(api.recorded("POST", "/oauth2/token")); got != 0 {
+		t.Errorf("%d token requests to the API host, want 0", got)
+	}
+	if got := len(sentCommands(t, api)); got != 1 {
+		t.Errorf("%d commands sent to the API host, want 1", got)
+	}
+
+	// -auth-url overrides the environment
+	cmd = cliCommand(t, api, "-aid", testAID, "-command", "ps", "-auth-url", auth.URL)
+	cmd.Env = append(cmd.Env, "CS_AUTH_URL="+unused.URL)
+	if _, stderr, code := runCommand(t, cmd); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if got := len(auth.recorded("POST", "/oauth2/token")); got != 2 {
+		t.Errorf("%d token requests to the -auth-url host, want 2", got)
+	}
+	if got := len(unused.recorded("POST", "/oauth2/token")); got != 0 {
+		t.Errorf("%d token requests to CS_AUTH_URL despite -auth-url", got)
+	}
+}
+
+func TestBaseURLFromEnv(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	unused := newFakeCrowdStrike(t)
+
+	// CS_BASE_URL stands in for -base-url, so drop the flag cliCommand adds
+	cmd := cliCommand(t, api, "-aid", testAID, "-command", "ps")
+	cmd.Args = append(cmd.Args[:1], cmd.Args[3:]...)
+	cmd.Env = append(cmd.Env, "CS_BASE_URL="+api.URL)
+	if _, stderr, code := runCommand(t, cmd); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if got := len(sentCommands(t, api)); got != 1 {
+		t.Errorf("%d commands sent to the CS_BASE_URL host, want 1", got)
+	}
+
+	// -base-url overrides the environment
+	cmd = cliCommand(t, api, "-aid", testAID, "-command", "ps")
+	cmd.Env = append(cmd.Env, "CS_BASE_URL="+unused.URL)
+	if _, stderr, code := runCommand(t, cmd); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if got := len(sentCommands(t, api)); got != 2 {
+		t.Errorf("%d commands sent to the -base-url host, want 2", got)
+	}
+	if got := len(unused.recorded("POST", "/oauth2/token")); got != 0 {
+		t.Errorf("%d token requests to CS_BASE_URL despite -base-url", got)
+	}
+}
+
+func TestResultWriterCSV(t *testing.T) {
+	results := []rtr.HostResult{
+		{HostID: "aaa", Stdout: "line one\nline \"two\", with comma", Complete: true},
+		{HostID: "bbb", Stderr: "denied", Complete: true},
+		{HostID: "ccc", Offline: true},
+		{HostID: "ddd", ErrorMessage: "timed out after 30s"},
+	}
+	w := &resultWriter{format: "csv"}
+	stdout, _ := captureOutput(t, func() {
+		for _, result := range results {
+			w.write(result)
+		}
+	})
+
+	records, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid CSV: %v\n%s", err, stdout)
+	}
+	want := [][]string{
+		{"host_id", "complete", "offline", "exit_code", "stdout", "stderr", "error"},
+		{"aaa", "true", "false", "0", "line one\nline \"two\", with comma", "", ""},
+		{"bbb", "true", "false", "1", "", "denied", ""},
+		{"ccc", "false", "true", "0", "", "", ""},
+		{"ddd", "false", "false", "1", "", "", "timed out after 30s"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("%d rows, want a header and one per host:\n%s", len(records), stdout)
+	}
+	for i := range want {
+		if strings.Join(records[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d = %q, want %q", i, records[i], want[i])
+		}
+	}
+}
+
+func TestRuncmdResults(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	c := newTestClient(t, api)
+
+	results, err := runcmd(context.Background(), c, []string{"aaa", "bbb"}, []string{"ps"}, 30*time.Second, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rtr.HostResult{
+		{HostID: "aaa", Stdout: "ran ps", Complete: true},
+		{HostID: "bbb", Stdout: "ran ps", Complete: true},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("results = %+v, want %+v", results, want)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, results[i], want[i])
+		}
+	}
+
+	// A batch that cannot start is returned as an error rather than printed
+	api.handle("POST "+rtrPath+"/combined/batch-init-session/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"errors": []map[string]interface{}{{"code": 500, "message": "init broke"}}})
+	})
+	stdout, stderr := captureOutput(t, func() {
+		results, err = runcmd(context.Background(), c, []string{"aaa"}, []string{"ps"}, 30*time.Second, false, nil)
+	})
+	if err == nil || !strings.Contains(err.Error(), "initializing batch") || !strings.Contains(err.Error(), "init broke") {
+		t.Errorf("error = %v, want the init failure", err)
+	}
+	if results != nil || stdout != "" || stderr != "" {
+		t.Errorf("failed run returned %+v and printed %q %q", results, stdout, stderr)
+	}
+}
+
+func TestLoadEnvFileSyntax(t *testing.T) {
+	want := map[string]string{
+		"CS_TEST_EXPORTED": "bar",
+		"CS_TEST_EQUALS":   "a=b",
+		"CS_TEST_HASH":     "with # hash",
+		"CS_TEST_COMMENT":  "value",
+		"CS_TEST_ANCHOR":   "a#b",
+		"CS_TEST_MULTI":    "first\nsecond",
+		"CS_TEST_AFTER":    "kept",
+	}
+	for key := range want {
+		unsetEnv(t, key)
+	}
+	unsetEnv(t, "CS_TEST_OPEN")
+
+	path := writeTempFile(t, ".env", strings.Join([]string{
+		"export CS_TEST_EXPORTED=bar",
+		"CS_TEST_EQUALS=a=b",
+		`CS_TEST_HASH="with # hash"`,
+		"CS_TEST_COMMENT=value # trailing comment",
+		"CS_TEST_ANCHOR=a#b",
+		`CS_TEST_MULTI="first`,
+		`second"`,
+		`CS_TEST_OPEN="never closed`,
+		"CS_TEST_AFTER=kept",
+	}, "\n"))
+	if _, err := loadEnvFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range want {
+		if got := os.Getenv(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if value, ok := os.LookupEnv("CS_TEST_OPEN"); ok {
+		t.Errorf("an unterminated quote was loaded as %q", value)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			testAID: map[string]interface{}{"complete": true, "stderr": "access denied"},
+		}}})
+	})
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	// An existing log is appended to, never truncated
+	if err := os.WriteFile(path, []byte("{\"previous\":true}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC().Add(-time.Second)
+	if _, stderr, code := runCLI(t, api, "-aid", testAID, "-command", "ls", "-args", `C:\`, "-audit-file", path, "-operator", "alice"); code != 1 {
+		t.Fatalf("exit code %d, want 1 for the failed host: %s", code, stderr)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 || lines[0] != `{"previous":true}` {
+		t.Fatalf("audit log =\n%s", content)
+	}
+	var record auditRecord
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Operator != "alice" || record.HostID != testAID || record.BaseCommand != "ls" || record.Command != `ls C:\` || record.Outcome != "failed" {
+		t.Errorf("record = %+v", record)
+	}
+	if record.Timestamp.Before(start) || record.Timestamp.After(time.Now().UTC()) {
+		t.Errorf("record timestamp %s is not from this run", record.Timestamp)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	stdout, stderr, code := runCLI(t, api, "-check")
+	if code != 0 || !strings.HasPrefix(stdout, "OK: "+api.URL) {
+		t.Fatalf("-check exited %d: %s%s", code, stdout, stderr)
+	}
+	searches := api.recorded("GET", "/devices/queries/devices-scroll/v1")
+	if len(searches) != 1 {
+		t.Fatalf("%d searches, want 1", len(searches))
+	}
+	if query, _ := url.ParseQuery(searches[0].Query); query.Get("limit") != "1" {
+		t.Errorf("search query = %s, want limit 1", searches[0].Query)
+	}
+	if requests := api.recorded("POST", rtrPath); len(requests) != 0 {
+		t.Errorf("-check sent RTR requests: %+v", requests)
+	}
+
+	// A token without the Hosts read scope fails the search
+	api.handle("GET /devices/queries/devices-scroll/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []map[string]interface{}{{"code": 403, "message": "access denied, authorization failed"}}})
+	})
+	if stdout, _, code := runCLI(t, api, "-check"); code != 1 || !strings.HasPrefix(stdout, "FAILED: ") || !strings.Contains(stdout, "authorization failed") {
+		t.Errorf("failed search exited %d: %s", code, stdout)
+	}
+
+	// So do rejected credentials
+	api.handle("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"errors": []map[string]interface{}{{"code": 401, "message": "invalid_client"}}})
+	})
+	if stdout, _, code := runCLI(t, api, "-check"); code != 1 || !strings.HasPrefix(stdout, "FAILED: ") {
+		t.Errorf("rejected credentials exited %d: %s", code, stdout)
+	}
+}
+
+func TestScopePreflight(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	api.handle("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"access_token": "test-token", "token_type": "bearer", "expires_in": 1800, "scope": "devices:read real-time-response:read",
+		})
+	})
+
+	// A read-only token stops an admin command before any session is opened
+	_, stderr, code := runCLI(t, api, "-aid", testAID, "-script-name", "collect")
+	if code != 1 || !strings.Contains(stderr, "missing required scopes") || !strings.Contains(stderr, "real-time-response-admin:write") {
+		t.Errorf("admin command with a read-only token exited %d: %s", code, stderr)
+	}
+	if requests := api.recorded("POST", rtrPath); len(requests) != 0 {
+		t.Errorf("sent RTR requests despite the missing scope: %+v", requests)
+	}
+
+	if _, stderr, code := runCLI(t, api, "-aid", testAID, "-command", "ps"); code != 0 {
+		t.Errorf("read command exited %d: %s", code, stderr)
+	}
+}
+
+func TestTargetByAID(t *testing.T) {
+	const otherAID = "FEDCBA9876543210FEDCBA9876543210"
+	api := newFakeCrowdStrike(t, "search-result")
+	if _, stderr, code := runCLI(t, api, "-aid", testAID, "-aid", otherAID, "-command", "ps"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	if searches := api.recorded("GET", "/devices/queries"); len(searches) != 0 {
+		t.Errorf("-aid searched for hosts: %+v", searches)
+	}
+	inits := api.recorded("POST", rtrPath+"/combined/batch-init-session/v1")
+	if len(inits) != 1 {
+		t.Fatalf("%d batch inits, want 1", len(inits))
+	}
+	var payload struct {
+		HostIDs []string `json:"host_ids"`
+	}
+	json.Unmarshal(inits[0].Body, &payload)
+	if got := strings.Join(payload.HostIDs, ","); got != testAID+","+strings.ToLower(otherAID) {
+		t.Errorf("batch host_ids = %s, want exactly the given agent IDs", got)
+	}
+
+	if stdout, _, code := runCLI(t, api, "-aid", "web-01", "-command", "ps"); code != 1 || !strings.Contains(stdout, `invalid agent ID "web-01"`) {
+		t.Errorf("malformed agent ID exited %d: %s", code, stdout)
+	}
+}
+
+func TestQueueOffline(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		api := newFakeCrowdStrike(t)
+		args := []string{"-aid", testAID, "-command", "ps"}
+		if enabled {
+			args = append(args, "-queue-offline")
+		}
+		if _, stderr, code := runCLI(t, api, args...); code != 0 {
+			t.Fatalf("exit code %d: %s", code, stderr)
+		}
+
+		inits := api.recorded("POST", rtrPath+"/combined/batch-init-session/v1")
+		if len(inits) != 1 {
+			t.Fatalf("%d batch inits, want 1", len(inits))
+		}
+		var payload map[string]interface{}
+		json.Unmarshal(inits[0].Body, &payload)
+		if queued, ok := payload["queue_offline"]; ok != enabled || (enabled && queued != true) {
+			t.Errorf("-queue-offline %v sent %s", enabled, inits[0].Body)
+		}
+	}
+}
+
+func TestRunInteractive(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	// Commands in a session without optional_hosts run on every host in it
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			CommandString string `json:"command_string"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"complete": true, "stdout": "ran " + payload.CommandString},
+		}}})
+	})
+
+	var out bytes.Buffer
+	in := strings.NewReader("ps\n\nls C:\\\nexit\nnetstat\n")
+	if err := runInteractive(context.Background(), newTestClient(t, api), "aaa", in, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := sentCommands(t, api)
+	if len(commands) != 2 || commands[0].CommandString != "ps" || commands[1].CommandString != `ls C:\` {
+		t.Errorf("sent %+v, want ps and ls before exit", commands)
+	}
+	if inits := api.recorded("POST", rtrPath+"/combined/batch-init-session/v1"); len(inits) != 1 {
+		t.Errorf("%d sessions opened, want 1 for the whole loop", len(inits))
+	}
+	for _, want := range []string{"rtr> ran ps\n", "ran ls C:\\\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunInteractiveSlowCommand(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	// Both commands are still running when the command call returns
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			CommandString string `json:"command_string"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"task_id": "task-" + payload.CommandString, "complete": false, "stdout": "partial"},
+		}}})
+	})
+	// ps finishes by the time it is polled; polling ls fails
+	api.handle("GET "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("cloud_request_id") == "task-ls" {
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"errors": []map[string]interface{}{{"code": 500, "message": "internal error"}}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"task_id": "task-ps", "complete": true, "stdout": "late output"},
+		}}})
+	})
+
+	var out bytes.Buffer
+	if err := runInteractive(context.Background(), newTestClient(t, api), "aaa", strings.NewReader("ps\nls\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// One prompt per command and a last one answered by the end of input
+	prompts := strings.Split(out.String(), "rtr> ")
+	if len(prompts) != 4 {
+		t.Fatalf("output = %q, want three prompts", out.String())
+	}
+	if got := prompts[1]; got != "late output\n" {
+		t.Errorf("ps printed %q, want its polled output", got)
+	}
+	if got := prompts[2]; !strings.Contains(got, "Error: waiting for the command to finish") || !strings.Contains(got, "still running on the host") || strings.Contains(got, "partial") {
+		t.Errorf("ls printed %q, want it reported as still running", got)
+	}
+}
+
+func TestScriptFile(t *testing.T) {
+	const script = "$procs = Get-Process |\r\n  Where-Object { $_.CPU -gt 10 }\r\n\r\n# \"busy\" processes\r\n$procs"
+	path := writeTempFile(t, "busy.ps1", script+"\r\n\r\n")
+
+	api := newFakeCrowdStrike(t)
+	if _, stderr, code := runCLI(t, api, "-aid", testAID, "-script-file", path); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	// From stdin as well
+	cmd := cliCommand(t, api, "-aid", testAID, "-script-file", "-")
+	cmd.Stdin = strings.NewReader(script + "\n")
+	if _, stderr, code := runCommand(t, cmd); code != 0 {
+		t.Fatalf("stdin exit code %d: %s", code, stderr)
+	}
+
+	commands := sentCommands(t, api)
+	if len(commands) != 2 {
+		t.Fatalf("sent %+v, want one command per run", commands)
+	}
+	for _, command := range commands {
+		if command.Endpoint != "batch-admin-command/v1" || command.BaseCommand != "runscript" || command.CommandString != "runscript -Raw=```"+script+"```" {
+			t.Errorf("sent %+v, want the script intact", command)
+		}
+	}
+}
+
+func TestRawScriptCommand(t *testing.T) {
+	for script, want := range map[string]string{
+		`Write-Output "it's done"`:              "runscript -Raw=```Write-Output \"it's done\"```",
+		"Write-Output `$HOME and `t tabs":       "runscript -Raw=```Write-Output `$HOME and `t tabs```",
+		"echo 'a'\necho \"b\" | sed 's/x/`y`/'": "runscript -Raw=```echo 'a'\necho \"b\" | sed 's/x/`y`/'```",
+	} {
+		if got, err := rawScriptCommand(script); err != nil || got != want {
+			t.Errorf("rawScriptCommand(%q) = %q, %v, want %q", script, got, err, want)
+		}
+	}
+
+	for _, script := range []string{"", " \n ", "echo ```nested```", "`starts with a backtick", "ends with a backtick`"} {
+		if got, err := rawScriptCommand(script); err == nil {
+			t.Errorf("rawScriptCommand(%q) = %q, want an error", script, got)
+		}
+	}
+}
+
+func TestPlatformFilter(t *testing.T) {
+	api := newFakeCrowdStrike(t, "aaa")
+	if _, stderr, code := runCLI(t, api, "-dry-run", "-platform", "Linux", "web-01,web-02"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	searches := api.recorded("GET", "/devices/queries/devices-scroll/v1")
+	if len(searches) != 1 {
+		t.Fatalf("%d searches, want 1", len(searches))
+	}
+	query, _ := url.ParseQuery(searches[0].Query)
+	if got, want := query.Get("filter"), "hostname:['web-01','web-02']+platform_name:'Linux'"; got != want {
+		t.Errorf("filter = %q, want %q", got, want)
+	}
+
+	if stdout, _, code := runCLI(t, api, "-dry-run", "-platform", "solaris", "web-01"); code != 1 || !strings.Contains(stdout, `unknown platform "solaris"`) {
+		t.Errorf("unknown platform exited %d: %s", code, stdout)
+	}
+}
+
+func TestConfirmTargets(t *testing.T) {
+	in, err := os.Open(writeTempFile(t, "answers", "y\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	// Input that is not a terminal is never prompted, so only the cap can stop a run
+	for _, tc := range []struct {
+		count, maxHosts int
+		yes, ok         bool
+	}{
+		{count: 5000, ok: true},
+		{count: 100, maxHosts: 100, ok: true},
+		{count: 101, maxHosts: 100},
+		{count: 101, maxHosts: 100, yes: true, ok: true},
+		{count: 3, maxHosts: 2},
+	} {
+		var prompt bytes.Buffer
+		err := confirmTargets(tc.count, tc.maxHosts, tc.yes, in, &prompt)
+		if (err == nil) != tc.ok {
+			t.Errorf("%d hosts with -max-hosts %d -yes %v: %v, want ok %v", tc.count, tc.maxHosts, tc.yes, err, tc.ok)
+		}
+		if prompt.Len() != 0 {
+			t.Errorf("prompted without a terminal: %q", prompt.String())
+		}
+	}
+
+	api := newFakeCrowdStrike(t, "aaa", "bbb", "ccc")
+	if stdout, _, code := runCLI(t, api, "-max-hosts", "2", "-command", "ps", "web-*"); code != 1 || !strings.Contains(stdout, "3 hosts matched, above -max-hosts 2") {
+		t.Errorf("run above the cap exited %d: %s", code, stdout)
+	}
+	if requests := api.recorded("POST", rtrPath); len(requests) != 0 {
+		t.Errorf("run above the cap sent RTR requests: %+v", requests)
+	}
+	if _, stderr, code := runCLI(t, api, "-max-hosts", "2", "-yes", "-command", "ps", "web-*"); code != 0 {
+		t.Errorf("run above the cap with -yes exited %d: %s", code, stderr)
+	}
+}
+
+func TestHostTimeouts(t *testing.T) {
+	// The API gives up on a host that is still running once the command timeout passes
+	api := newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"fast": map[string]interface{}{"complete": true, "stdout": "done"},
+			"hung": map[string]interface{}{"complete": false},
+		}}})
+	})
+	results, err := runcmd(context.Background(), newTestClient(t, api), []string{"fast", "hung"}, []string{"ps"}, 45*time.Second, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Failed() || r.Stdout != "done" {
+		t.Errorf("finished host = %+v", r)
+	}
+	if r := results[1]; r.ErrorMessage != "timed out after 45s" || r.Offline {
+		t.Errorf("hung host = %+v, want timed out", r)
+	}
+
+	// A call held open past the client timeout is waited for, not abandoned and sent again
+	api = newFakeCrowdStrike(t)
+	c := newTestClient(t, api)
+	c.MaxRetries = 3
+	c.SetTimeout(50 * time.Millisecond)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"slow": map[string]interface{}{"complete": true, "stdout": "done"},
+		}}})
+	})
+	if results, err := runcmd(context.Background(), c, []string{"slow"}, []string{"ps"}, 30*time.Second, false, nil); err != nil || results[0].Stdout != "done" {
+		t.Errorf("slow command = %+v, %v", results, err)
+	}
+	if got := len(sentCommands(t, api)); got != 1 {
+		t.Errorf("command sent %d times, want 1", got)
+	}
+
+	// Batches cut off or never started by -deadline count as failed
+	const otherAID = "fedcba9876543210fedcba9876543210"
+	api = newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	_, stderr, code := runCLI(t, api, "-aid", testAID, "-aid", otherAID, "-batch-size", "1", "-workers", "1", "-command", "ps", "-deadline", "500ms")
+	if code != 1 || !strings.Contains(stderr, "2 failed") {
+		t.Errorf("run past the deadline exited %d: %s", code, stderr)
+	}
+	if got := len(sentCommands(t, api)); got != 1 {
+		t.Errorf("%d batches started, want only the one running when the deadline passed", got)
+	}
+}
+
+func TestOutputTakenWhenComplete(t *testing.T) {
+	// The command call returns before the host finishes, with partial output
+	partial := []byte(`{"combined":{"resources":{"aaa":{"task_id":"task-1","complete":false,"stdout":"partial"}}}}`)
+	parsed, err := rtr.ParseBatchResults(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := parsed["aaa"]; r.Complete || r.Stdout != "" {
+		t.Errorf("incomplete result = %+v, want no output", r)
+	}
+
+	api := newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(partial)
+	})
+	api.handle("GET "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("cloud_request_id"); got != "task-1" {
+			t.Errorf("polled cloud_request_id %q", got)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"task_id": "task-1", "complete": true, "stdout": "full output"},
+		}}})
+	})
+
+	results, err := runcmd(context.Background(), newTestClient(t, api), []string{"aaa"}, []string{"ps"}, 30*time.Second, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; !r.Complete || r.Stdout != "full output" || r.Failed() {
+		t.Errorf("result = %+v, want the output of the complete response", r)
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	body := []byte(`{"combined":{"resources":{"aaa":{"complete":true,"stdout":"it's \"here\"\n","unexpected_field":[1,2]}}},"errors":[]}`)
+	w := &resultWriter{format: "text"}
+	stdout, _ := captureOutput(t, func() {
+		w.writeRaw(body)
+		w.writeRaw([]byte("<html>not json"))
+	})
+
+	var want bytes.Buffer
+	json.Indent(&want, body, "", "  ")
+	if !strings.HasPrefix(stdout, want.String()+"\n") {
+		t.Errorf("raw output =\n%s\nwant\n%s", stdout, want.String())
+	}
+	// Only whitespace differs from the response as received
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, []byte(strings.TrimSuffix(stdout, "\n<html>not json\n"))); err != nil || compacted.String() != string(body) {
+		t.Errorf("compacted output = %s, %v, want %s", compacted.String(), err, body)
+	}
+	if !strings.HasSuffix(stdout, "\n<html>not json\n") {
+		t.Errorf("invalid JSON was not printed as received:\n%s", stdout)
+	}
+
+	api := newFakeCrowdStrike(t)
+	stdout, stderr, code := runCLI(t, api, "-aid", testAID, "-command", "ps", "-raw")
+	if code != 0 || !strings.Contains(stdout, `"stdout": "ran ps"`) {
+		t.Errorf("-raw exited %d:\n%s%s", code, stdout, stderr)
+	}
+}
+
+func TestShortcutCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name, value        string
+		wantBase, wantArgs string
+	}{
+		{"get-file", `C:\Windows\System32\drivers\etc\hosts`, "get", `C:\Windows\System32\drivers\etc\hosts`},
+		{"get-file", `C:\Program Files\app.log`, "get", `"C:\Program Files\app.log"`},
+		{"kill-process", "4242", "kill", "4242"},
+		{"list-dir", "/var/log", "ls", "/var/log"},
+	} {
+		base, args, err := shortcutCommand(tc.name, tc.value)
+		if err != nil || base != tc.wantBase || args != tc.wantArgs {
+			t.Errorf("-%s %s = %q, %q, %v, want %q, %q", tc.name, tc.value, base, args, err, tc.wantBase, tc.wantArgs)
+		}
+	}
+	if _, _, err := shortcutCommand("kill-process", "explorer.exe"); err == nil {
+		t.Error("-kill-process accepted a process name")
+	}
+
+	api := newFakeCrowdStrike(t)
+	if _, stderr, code := runCLI(t, api, "-aid", testAID, "-kill-process", "4242"); code != 0 {
+		t.Fatalf("-kill-process exited %d: %s", code, stderr)
+	}
+	if commands := sentCommands(t, api); len(commands) != 1 || commands[0].Endpoint != "batch-active-responder-command/v1" || commands[0].CommandString != "kill 4242" {
+		t.Errorf("-kill-process sent %+v", commands)
+	}
+}
+
+func TestRunGetFile(t *testing.T) {
+	const getPath = rtrPath + "/combined/batch-get-command/v1"
+	api := newFakeCrowdStrike(t)
+	// ccc is offline, so it is left out of the response
+	api.handle("POST "+getPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"batch_get_cmd_req_id": "req-1",
+			"combined": map[string]interface{}{"resources": map[string]interface{}{
+				"aaa": map[string]interface{}{"session_id": "session-aaa", "complete": true},
+				"bbb": map[string]interface{}{"session_id": "session-bbb", "complete": true, "stderr": "file not found"},
+			}},
+		})
+	})
+	api.handle("GET "+getPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": []map[string]interface{}{{"session_id": "session-aaa", "sha256": "abc123", "name": `C:\app.log`}},
+		}})
+	})
+	api.handle("GET "+rtrPath+"/entities/extracted-file-contents/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-7z-compressed")
+		w.Write([]byte("7z-archive"))
+	})
+
+	dir := t.TempDir()
+	results, err := runGetFile(context.Background(), newTestClient(t, api), []string{"aaa", "bbb", "ccc"}, `C:\app.log`, dir, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := filepath.Join(dir, "aaa.7z")
+	if r := results[0]; r.Failed() || r.Stdout != `Saved C:\app.log (sha256 abc123) to `+saved {
+		t.Errorf("aaa = %+v", r)
+	}
+	if content, err := os.ReadFile(saved); err != nil || string(content) != "7z-archive" {
+		t.Errorf("saved file = %q, %v", content, err)
+	}
+	if r := results[1]; r.Stderr != "file not found" {
+		t.Errorf("bbb = %+v, want the host's error", r)
+	}
+	if r := results[2]; !r.Offline {
+		t.Errorf("ccc = %+v, want offline", r)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal(api.recorded("POST", getPath)[0].Body, &payload)
+	if payload["file_path"] != `C:\app.log` {
+		t.Errorf("get payload = %v", payload)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	p := &progress{total: 5, start: time.Now()}
+	_, stderr := captureOutput(t, func() {
+		// Hidden with -quiet or when stderr is not a terminal, as it is here
+		if bar := newProgress(5, false); bar != nil {
+			t.Error("progress shown on a non-terminal stderr")
+		}
+		if bar := newProgress(5, true); bar != nil {
+			t.Error("progress shown with -quiet")
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range []int{1, 1, 2} {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				p.add(n)
+			}(n)
+		}
+		wg.Wait()
+		p.add(1)
+		p.finish()
+	})
+
+	if p.done != 5 {
+		t.Errorf("done = %d, want 5", p.done)
+	}
+	if !strings.Contains(stderr, "\r5/5 hosts done (") || !strings.HasSuffix(stderr, "hosts/s)\n") {
+		t.Errorf("progress output = %q", stderr)
+	}
+	if got := strings.Count(stderr, "\r"); got != 4 {
+		t.Errorf("line drawn %d times, want once per update", got)
+	}
+
+	var nilBar *progress
+	nilBar.add(1)
+	nilBar.finish()
+}
+
+func TestNoDelayBetweenBatches(t *testing.T) {
+	var aids []string
+	for i := 0; i < 8; i++ {
+		aids = append(aids, "-aid", fmt.Sprintf("%032x", i))
+	}
+	api := newFakeCrowdStrike(t)
+
+	// One worker runs the batches back to back; a fixed pause after each would add up
+	start := time.Now()
+	if _, stderr, code := runCLI(t, api, append(aids, "-batch-size", "1", "-workers", "1", "-command", "ps")...); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("8 batches took %s", elapsed)
+	}
+	if got := len(sentCommands(t, api)); got != 8 {
+		t.Errorf("%d commands sent, want 8", got)
+	}
+}
+
+func TestPanickingBatchReported(t *testing.T) {
+	jobs := planJobs([]string{"aaa", "bbb", "ccc", "ddd"}, 1, []string{"ps"})
+	reported := make(map[string]rtr.HostResult)
+
+	collectResults(jobs, 2, 2, func(job batchJob, emit func([]rtr.HostResult)) []rtr.HostResult {
+		if job.hosts[0] == "bbb" {
+			panic("unexpected response")
+		}
+		return []rtr.HostResult{{HostID: job.hosts[0], Complete: true, Stdout: "ok"}}
+	}, func(job batchJob, recovered interface{}) []rtr.HostResult {
+		return failedResults(job.hosts, fmt.Errorf("internal error: %v", recovered))
+	}, func(outcome batchOutcome) {
+		for _, result := range outcome.results {
+			reported[result.HostID] = result
+		}
+	})
+
+	if len(reported) != 4 {
+		t.Fatalf("reported %d hosts, want every host: %+v", len(reported), reported)
+	}
+	if r := reported["bbb"]; r.ErrorMessage != "internal error: unexpected response" {
+		t.Errorf("panicking host = %+v, want a failure", r)
+	}
+	for _, host := range []string{"aaa", "ccc", "ddd"} {
+		if r := reported[host]; r.Failed() || r.Stdout != "ok" {
+			t.Errorf("%s = %+v, want its own result", host, r)
+		}
+	}
+}
+
+func TestPerPlatformScripts(t *testing.T) {
+	platforms := map[string]string{"win": "Windows", "lin": "Linux", "mac": "Mac", "unknown": ""}
+	details := make(map[string]rtr.HostInfo)
+	for host, platform := range platforms {
+		details[host] = rtr.HostInfo{HostID: host, PlatformName: platform}
+	}
+	groups, unmatched := groupByPlatform([]string{"win", "lin", "mac", "unknown"}, details, map[string]string{"Windows": "ps1", "Linux": "sh"})
+	if len(groups) != 2 || strings.Join(groups["Windows"], ",") != "win" || strings.Join(groups["Linux"], ",") != "lin" {
+		t.Errorf("groups = %v", groups)
+	}
+	if strings.Join(unmatched, ",") != "mac,unknown" {
+		t.Errorf("unmatched = %v", unmatched)
+	}
+
+	// End to end, each host runs the script for its platform
+	api := newFakeCrowdStrike(t, "win", "lin", "mac")
+	api.handle("GET /devices/entities/devices/v2", func(w http.ResponseWriter, r *http.Request) {
+		var devices []map[string]interface{}
+		for _, id := range r.URL.Query()["ids"] {
+			devices = append(devices, map[string]interface{}{"device_id": id, "hostname": "name-" + id, "platform_name": platforms[id]})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": devices})
+	})
+	_, stderr, code := runCLI(t, api, "-script-windows", "Get-Process", "-script-linux", "ps aux", "web-*")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	scripts := make(map[string]string)
+	for _, command := range sentCommands(t, api) {
+		for _, host := range command.OptionalHosts {
+			scripts[host] = command.CommandString
+		}
+	}
+	if scripts["win"] != "runscript -Raw=```Get-Process```" || scripts["lin"] != "runscript -Raw=```ps aux```" {
+		t.Errorf("scripts by host = %v", scripts)
+	}
+	if _, ok := scripts["mac"]; ok || !strings.Contains(stderr, `Skipping host name-mac (mac): no script for platform "Mac"`) {
+		t.Errorf("host without a script was not skipped and reported: %v\n%s", scripts, stderr)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	api := newFakeCrowdStrike(t, "aaa", "bbb")
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if _, stderr, code := runCLI(t, api, "-manifest", path, "-command", "ls", "-args", `C:\`, "-select-by", "tag", "prod"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"version", "started_at", "finished_at", "selection", "hosts", "commands", "summary"} {
+		if _, ok := manifest[key]; !ok {
+			t.Errorf("manifest is missing %q:\n%s", key, data)
+		}
+	}
+
+	var decoded runManifest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Version != version || decoded.FinishedAt.Before(decoded.StartedAt) {
+		t.Errorf("version %q, started %s, finished %s", decoded.Version, decoded.StartedAt, decoded.FinishedAt)
+	}
+	if decoded.Selection.Filter != "tags:'prod'" {
+		t.Errorf("selection = %+v", decoded.Selection)
+	}
+	if strings.Join(decoded.Hosts, ",") != "aaa,bbb" {
+		t.Errorf("hosts = %v", decoded.Hosts)
+	}
+	if len(decoded.Commands) != 1 || decoded.Commands[0] != (manifestCommand{BaseCommand: "ls", Command: `ls C:\`}) {
+		t.Errorf("commands = %+v", decoded.Commands)
+	}
+	if decoded.Summary == nil || decoded.Summary.Total != 2 || decoded.Summary.Succeeded != 2 {
+		t.Errorf("summary = %+v", decoded.Summary)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "1.4.0", "abc1234"
+	if got, want := versionString(), "crowdstrike-cli 1.4.0 (commit abc1234, "+runtime.Version()+")"; got != want {
+		t.Errorf("versionString() = %q, want %q", got, want)
+	}
+
+	stdout, _, code := runCLI(t, newFakeCrowdStrike(t), "-version")
+	if code != 0 || !strings.HasPrefix(stdout, "crowdstrike-cli dev (commit ") || !strings.HasSuffix(stdout, runtime.Version()+")\n") {
+		t.Errorf("-version exited %d: %q", code, stdout)
+	}
+}
+
+func TestCommandSequence(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	path := writeTempFile(t, "commands.txt", "# triage\ncd C:\\Temp\nls\n")
+	stdout, stderr, code := runCLI(t, api, "-aid", testAID, "-commands-file", path)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	if inits := api.recorded("POST", rtrPath+"/combined/batch-init-session/v1"); len(inits) != 1 {
+		t.Errorf("%d sessions opened, want 1 for the sequence", len(inits))
+	}
+	var batchIDs, commandStrings []string
+	for _, req := range api.recorded("POST", rtrPath+"/combined/batch-command/v1") {
+		var payload struct {
+			BatchID       string `json:"batch_id"`
+			CommandString string `json:"command_string"`
+		}
+		json.Unmarshal(req.Body, &payload)
+		batchIDs = append(batchIDs, payload.BatchID)
+		commandStrings = append(commandStrings, payload.CommandString)
+	}
+	if strings.Join(commandStrings, "|") != `cd C:\Temp|ls` || strings.Join(batchIDs, ",") != "batch-1,batch-1" {
+		t.Errorf("sent %q on batches %q, want both commands in order on batch-1", commandStrings, batchIDs)
+	}
+	if !strings.Contains(stdout, "> cd C:\\Temp\nran cd C:\\Temp\n> ls\nran ls\n") {
+		t.Errorf("output does not collect both commands:\n%s", stdout)
+	}
+
+	// A host stops at its first error unless continueOnError is set
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			OptionalHosts []string `json:"optional_hosts"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		results := make(map[string]interface{})
+		for _, host := range payload.OptionalHosts {
+			result := map[string]interface{}{"complete": true, "stdout": "ok"}
+			if host == "bad" {
+				result["stderr"] = "access denied"
+			}
+			results[host] = result
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": results}})
+	})
+	for _, continueOnError := range []bool{false, true} {
+		before := len(sentCommands(t, api))
+		if _, err := runcmd(context.Background(), newTestClient(t, api), []string{"good", "bad"}, []string{"cd C:\\Temp", "ls"}, 30*time.Second, continueOnError, nil); err != nil {
+			t.Fatal(err)
+		}
+		commands := sentCommands(t, api)[before:]
+		want := "good"
+		if continueOnError {
+			want = "good,bad"
+		}
+		if len(commands) != 2 || strings.Join(commands[1].OptionalHosts, ",") != want {
+			t.Errorf("continueOnError %v sent %+v, want the second command on %s", continueOnError, commands, want)
+		}
+	}
+}
+
+func TestRuncmdSkipsUninitializedHosts(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-init-session/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"batch_id": "batch-1", "resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"session_id": "session-aaa"},
+			"bbb": map[string]interface{}{"errors": []map[string]interface{}{{"code": 40007, "message": "host already in a session"}}},
+		}})
+	})
+
+	results, err := runcmd(context.Background(), newTestClient(t, api), []string{"aaa", "bbb"}, []string{"ps"}, 30*time.Second, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commands := sentCommands(t, api); len(commands) != 1 || strings.Join(commands[0].OptionalHosts, ",") != "aaa" {
+		t.Errorf("sent %+v, want the command only on the initialized host", commands)
+	}
+	if r := results[0]; r.Stdout != "ran ps" || r.Failed() {
+		t.Errorf("aaa = %+v", r)
+	}
+	if r := results[1]; r.ErrorMessage != "session init failed: host already in a session" {
+		t.Errorf("bbb = %+v, want the init failure", r)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	cmd := cliCommand(t, api, "-aid", testAID, "-command", "ps", "-repeat", "-interval", "50ms")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt once the command has run twice
+	deadline := time.Now().Add(10 * time.Second)
+	for len(sentCommands(t, api)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd.Process.Signal(os.Interrupt)
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("interrupted run: %v\n%s", err, stderr.String())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("the run did not stop after an interrupt")
+	}
+
+	if got := len(sentCommands(t, api)); got < 2 {
+		t.Fatalf("command ran %d times, want at least 2", got)
+	}
+	for _, want := range []string{"=== Run 1 at ", "=== Run 2 at "} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, stdout.String())
+		}
+	}
+	if got := strings.Count(stdout.String(), "ran ps\n"); got < 2 {
+		t.Errorf("output has %d results, want one per run:\n%s", got, stdout.String())
+	}
+}
+
+func TestMatchOutput(t *testing.T) {
+	found, clean := fmt.Sprintf("%032x", 1), fmt.Sprintf("%032x", 2)
+	api := newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			found: map[string]interface{}{"complete": true, "stdout": "evil.exe running"},
+			clean: map[string]interface{}{"complete": true, "stdout": "nothing here"},
+		}}})
+	})
+
+	for _, tc := range []struct {
+		flag       string
+		want, hide string
+	}{
+		{"-match", "evil.exe running", "nothing here"},
+		{"-no-match", "nothing here", "evil.exe running"},
+	} {
+		stdout, stderr, code := runCLI(t, api, "-aid", found, "-aid", clean, "-command", "ps", tc.flag, `evil\.exe`)
+		if code != 0 {
+			t.Fatalf("%s: exit code %d: %s", tc.flag, code, stderr)
+		}
+		if !strings.Contains(stdout, tc.want) || strings.Contains(stdout, tc.hide) {
+			t.Errorf("%s printed:\n%s", tc.flag, stdout)
+		}
+		if !strings.Contains(stderr, "2 succeeded") || !strings.Contains(stderr, ", 1 suppressed") {
+			t.Errorf("%s summary = %q", tc.flag, stderr)
+		}
+	}
+
+	if _, stderr, code := runCLI(t, api, "-aid", found, "-command", "ps", "-match", "a", "-no-match", "b"); code != 1 {
+		t.Errorf("-match with -no-match exited %d: %s", code, stderr)
+	}
+}
+
+func TestBatchResponseShape(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	client := newTestClient(t, api)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// A host left out of a response of the expected shape is offline
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"complete": true, "stdout": "fine"},
+		}}})
+	})
+	results, err := execBatchCommand(ctx, client, "batch-1", []string{"aaa", "bbb"}, "ps", 30*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Stdout != "fine" || r.Failed() {
+		t.Errorf("aaa = %+v", r)
+	}
+	if r := results[1]; !r.Offline || r.ErrorMessage != "" {
+		t.Errorf("missing host = %+v, want offline", r)
+	}
+
+	// A response of another shape fails every host instead of reporting them offline
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"resources": map[string]interface{}{
+			"aaa": map[string]interface{}{"complete": true, "stdout": "fine"},
+		}})
+	})
+	results, err = execBatchCommand(ctx, client, "batch-1", []string{"aaa", "bbb"}, "ps", 30*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Offline || r.ErrorMessage != "no result for host in batch response" {
+			t.Errorf("host %s = %+v, want a failure", r.HostID, r)
+		}
+	}
+}
+
+func TestFieldsFlag(t *testing.T) {
+	api := newFakeCrowdStrike(t, "aaa")
+	api.handle("GET /devices/entities/devices/v2", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []map[string]interface{}{{
+			"device_id": "aaa", "hostname": "web-1", "platform_name": "Linux", "tags": []string{"prod", "web"}, "serial_number": "SN1",
+		}}})
+	})
+
+	stdout, stderr, code := runCLI(t, api, "-dry-run", "-fields", "tags, platform_name", "web-*")
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s%s", code, stdout, stderr)
+	}
+	if !strings.Contains(stdout, "aaa\tprod,web\tLinux\n") {
+		t.Errorf("output:\n%s", stdout)
+	}
+	if got := api.recorded("GET", "/devices/entities/devices/v2")[0].Query; !strings.Contains(got, "fields=device_id%2Chostname%2Cplatform_name%2Ctags") {
+		t.Errorf("lookup query = %s", got)
+	}
+
+	if _, stderr, code := runCLI(t, api, "-dry-run", "-fields", "password", "web-*"); code != 1 || !strings.Contains(stderr, "unknown host field") {
+		t.Errorf("unknown field exited %d: %s", code, stderr)
+	}
+}
+
+func TestClientCertificateFlags(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	for _, args := range [][]string{{"-client-cert", "client.crt"}, {"-client-key", "client.key"}} {
+		stdout, _, code := runCLI(t, api, append(args, "-aid", testAID, "-command", "ps")...)
+		if code != 1 || !strings.Contains(stdout, "-client-cert and -client-key") {
+			t.Errorf("%v exited %d: %s", args, code, stdout)
+		}
+	}
+	if requests := api.recorded("POST", "/"); len(requests) != 0 {
+		t.Errorf("sent requests with an incomplete certificate pair: %+v", requests)
+	}
+}
+
+func TestNoHostsMatched(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	for _, args := range [][]string{{"-command", "ps", "web-*"}, {"-dry-run", "web-*"}} {
+		stdout, stderr, code := runCLI(t, api, args...)
+		if code != noHostsExitCode {
+			t.Errorf("%v: exit code %d, want %d\n%s%s", args, code, noHostsExitCode, stdout, stderr)
+		}
+		if !strings.Contains(stderr, "No hosts matched filter ") || !strings.Contains(stderr, "web-*") {
+			t.Errorf("%v: stderr = %q", args, stderr)
+		}
+	}
+	if requests := api.recorded("POST", rtrPath); len(requests) != 0 {
+		t.Errorf("sent RTR requests without hosts: %+v", requests)
+	}
+}
+
+func TestIncludeHiddenFlag(t *testing.T) {
+	api := newFakeCrowdStrike(t, "aaa")
+	api.handle("GET /devices/queries/devices-hidden/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"meta":      map[string]interface{}{"pagination": map[string]interface{}{"total": 1}},
+			"resources": []string{"hidden-host"},
+		})
+	})
+
+	stdout, stderr, code := runCLI(t, api, "-dry-run", "web-*")
+	if code != 0 || strings.Contains(stdout, "hidden-host") || len(api.recorded("GET", "/devices/queries/devices-hidden/")) != 0 {
+		t.Errorf("without -include-hidden exited %d:\n%s%s", code, stdout, stderr)
+	}
+
+	stdout, stderr, code = runCLI(t, api, "-dry-run", "-include-hidden", "web-*")
+	if code != 0 || !strings.Contains(stdout, "aaa\t") || !strings.Contains(stdout, "hidden-host\t") {
+		t.Errorf("with -include-hidden exited %d:\n%s%s", code, stdout, stderr)
+	}
+	queries := api.recorded("GET", "/devices/queries/devices-hidden/")
+	if len(queries) != 1 || !strings.Contains(queries[0].Query, "filter=") {
+		t.Errorf("hidden queries = %+v", queries)
+	}
+}
+
+func TestMetricsFile(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	path := filepath.Join(t.TempDir(), "crowdstrike.prom")
+	if _, stderr, code := runCLI(t, api, "-aid", testAID, "-command", "ps", "-metrics-file", path); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Parse the exposition format: "# TYPE name kind" lines and "name{labels} value" samples
+	types := make(map[string]string)
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		samples[line[:i]] = value
+	}
+
+	for name, kind := range map[string]string{
+		"crowdstrike_cli_api_requests_total":           "counter",
+		"crowdstrike_cli_api_request_errors_total":     "counter",
+		"crowdstrike_cli_api_request_duration_seconds": "summary",
+		"crowdstrike_cli_auth_duration_seconds":        "summary",
+		"crowdstrike_cli_run_duration_seconds":         "gauge",
+		"crowdstrike_cli_hosts":                        "gauge",
+	} {
+		if types[name] != kind {
+			t.Errorf("%s has type %q, want %s", name, types[name], kind)
+		}
+	}
+	for sample, want := range map[string]float64{
+		`crowdstrike_cli_api_requests_total{method="POST",path="/real-time-response/combined/batch-command/v1",code="201"}`:      1,
+		`crowdstrike_cli_api_request_errors_total{method="POST",path="/real-time-response/combined/batch-command/v1"}`:           0,
+		`crowdstrike_cli_api_request_duration_seconds_count{method="POST",path="/real-time-response/combined/batch-command/v1"}`: 1,
+		`crowdstrike_cli_auth_duration_seconds_count`: 1,
+		`crowdstrike_cli_hosts{result="succeeded"}`:   1,
+		`crowdstrike_cli_hosts{result="failed"}`:      0,
+	} {
+		if got, ok := samples[sample]; !ok || got != want {
+			t.Errorf("%s = %v (present %v), want %v", sample, got, ok, want)
+		}
+	}
+	if samples["crowdstrike_cli_run_duration_seconds"] <= 0 {
+		t.Error("run duration is not positive")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	results := []rtr.HostResult{
+		{HostID: "ccc", Hostname: "alpha"},
+		{HostID: "aaa"},
+		{HostID: "ddd", Hostname: "Bravo"},
+		{HostID: "bbb", Hostname: "charlie"},
+		{HostID: "000"},
+	}
+	order := func() string {
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.HostID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	sortResults(results, "hostname")
+	if got := order(); got != "ccc,ddd,bbb,000,aaa" {
+		t.Errorf("by hostname = %s, want case-insensitive hostnames then unknown hostnames by ID", got)
+	}
+	sortResults(results, "host")
+	if got := order(); got != "000,aaa,bbb,ccc,ddd" {
+		t.Errorf("by host = %s", got)
+	}
+
+	// End to end, hostnames run the opposite way to the agent IDs
+	ids := []string{fmt.Sprintf("%032x", 3), fmt.Sprintf("%032x", 1), fmt.Sprintf("%032x", 2)}
+	hostnames := map[string]string{ids[0]: "web-a", ids[1]: "web-c", ids[2]: "web-b"}
+	api := newFakeCrowdStrike(t)
+	api.handle("GET /devices/entities/devices/v2", func(w http.ResponseWriter, r *http.Request) {
+		var devices []map[string]interface{}
+		for _, id := range r.URL.Query()["ids"] {
+			devices = append(devices, map[string]interface{}{"device_id": id, "hostname": hostnames[id]})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": devices})
+	})
+	for _, tc := range []struct {
+		by   string
+		want []string
+	}{
+		{"hostname", []string{"web-a", "web-b", "web-c"}},
+		{"host", []string{"web-c", "web-b", "web-a"}},
+	} {
+		args := []string{"-command", "ps", "-batch-size", "1", "-sort", tc.by}
+		for _, id := range ids {
+			args = append(args, "-aid", id)
+		}
+		stdout, stderr, code := runCLI(t, api, args...)
+		if code != 0 {
+			t.Fatalf("-sort %s: exit code %d: %s", tc.by, code, stderr)
+		}
+		last := -1
+		for _, hostname := range tc.want {
+			i := strings.Index(stdout, hostname)
+			if i <= last {
+				t.Errorf("-sort %s printed %s out of order:\n%s", tc.by, hostname, stdout)
+			}
+			last = i
+		}
+	}
+
+	if stdout, _, code := runCLI(t, api, "-aid", ids[0], "-command", "ps", "-sort", "name"); code != 1 || !strings.Contains(stdout, "unknown -sort value") {
+		t.Errorf("-sort name exited %d: %s", code, stdout)
+	}
+}
+
+func TestSeenWithin(t *testing.T) {
+	api := newFakeCrowdStrike(t, "aaa")
+	if _, stderr, code := runCLI(t, api, "-dry-run", "-seen-within", "1h", "-platform", "linux", "web-01"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	searches := api.recorded("GET", "/devices/queries/devices-scroll/v1")
+	if len(searches) != 1 {
+		t.Fatalf("%d searches, want 1", len(searches))
+	}
+	query, _ := url.ParseQuery(searches[0].Query)
+	if got, want := query.Get("filter"), "hostname:'web-01'+platform_name:'Linux'+last_seen:>'now-1h'"; got != want {
+		t.Errorf("filter = %q, want %q", got, want)
+	}
+
+	for _, args := range [][]string{{"-seen-within", "30s", "web-01"}, {"-seen-within", "1h", "-aid", testAID}} {
+		if stdout, _, code := runCLI(t, api, append([]string{"-dry-run"}, args...)...); code != 1 || !strings.Contains(stdout, "Error: -seen-within") {
+			t.Errorf("%v exited %d: %s", args, code, stdout)
+		}
+	}
+}
+
+func TestResultTemplate(t *testing.T) {
+	tmpl, err := parseResultTemplate(`{{.HostID}} {{json .Hostname}}: {{trim .Stdout}}{{if .Failed}} FAILED {{.ErrorMessage}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &resultWriter{format: "text", tmpl: tmpl}
+	stdout, _ := captureOutput(t, func() {
+		w.write(rtr.HostResult{HostID: "aaa", Hostname: `web "1"`, Complete: true, Stdout: "  listing\n"})
+		w.write(rtr.HostResult{HostID: "bbb", ErrorMessage: "session expired"})
+	})
+	if want := "aaa \"web \\\"1\\\"\": listing\nbbb \"\":  FAILED session expired\n"; stdout != want {
+		t.Errorf("rendered %q, want %q", stdout, want)
+	}
+
+	// Mistakes are reported before anything runs
+	api := newFakeCrowdStrike(t)
+	for _, args := range [][]string{
+		{"-template", "{{.HostID"},
+		{"-template", "{{.HostID}}", "-output", "json"},
+	} {
+		stdout, _, code := runCLI(t, api, append(args, "-aid", testAID, "-command", "ps")...)
+		if code != 1 || !strings.Contains(stdout, "-template") {
+			t.Errorf("%v exited %d: %s", args, code, stdout)
+		}
+	}
+	if requests := api.recorded("POST", rtrPath); len(requests) != 0 {
+		t.Errorf("sent RTR requests with an invalid template: %+v", requests)
+	}
+
+	stdout, stderr, code := runCLI(t, api, "-aid", testAID, "-command", "ps", "-template", "{{.Hostname}}={{.Stdout}}")
+	if code != 0 || stdout != "name-"+testAID+"=ran ps\n" {
+		t.Errorf("exit code %d, output %q: %s", code, stdout, stderr)
+	}
+}
+
+func TestStateFileResume(t *testing.T) {
+	var aids []string
+	var hosts []string
+	for i := 1; i <= 4; i++ {
+		hosts = append(hosts, fmt.Sprintf("%032x", i))
+		aids = append(aids, "-aid", hosts[i-1])
+	}
+	statePath := filepath.Join(t.TempDir(), "run.state")
+	args := append(aids, "-batch-size", "1", "-workers", "1", "-command", "ps", "-state-file", statePath)
+
+	// The first run is interrupted while the third host is running
+	api := newFakeCrowdStrike(t)
+	reached := make(chan struct{})
+	var once sync.Once
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		var payload sentCommand
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		if payload.OptionalHosts[0] != hosts[2] {
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+				payload.OptionalHosts[0]: map[string]interface{}{"complete": true, "stdout": "ran ps"},
+			}}})
+			return
+		}
+		once.Do(func() { close(reached) })
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	})
+	cmd := cliCommand(t, api, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reached:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("the third host was never run:\n%s", stderr.String())
+	}
+	cmd.Process.Signal(os.Interrupt)
+	cmd.Wait()
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), hosts[0]+"\n"+hosts[1]+"\n"; got != want {
+		t.Fatalf("state after the interruption = %q, want the two completed hosts", got)
+	}
+
+	// Resuming runs only the hosts that did not complete
+	api = newFakeCrowdStrike(t)
+	_, stderrOut, code := runCLI(t, api, args...)
+	if code != 0 {
+		t.Fatalf("resumed run exit code %d: %s", code, stderrOut)
+	}
+	var ran []string
+	for _, command := range sentCommands(t, api) {
+		ran = append(ran, command.OptionalHosts...)
+	}
+	if strings.Join(ran, ",") != hosts[2]+","+hosts[3] {
+		t.Errorf("resumed run ran %v, want the last two hosts", ran)
+	}
+	if !strings.Contains(stderrOut, "Skipping 2 host(s) already completed") {
+		t.Errorf("stderr = %q", stderrOut)
+	}
+
+	// Once everything completed, nothing runs again
+	api = newFakeCrowdStrike(t)
+	if _, stderrOut, code := runCLI(t, api, args...); code != 0 || !strings.Contains(stderrOut, "Every matched host has already completed") {
+		t.Errorf("finished run exit code %d: %s", code, stderrOut)
+	}
+	if commands := sentCommands(t, api); len(commands) != 0 {
+		t.Errorf("finished run sent %+v", commands)
+	}
+}
+
+func TestStateFileRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.state")
+	state, err := openStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range []rtr.HostResult{
+		{HostID: "done", Complete: true, Stdout: "ok"},
+		{HostID: "offline", Offline: true},
+		{HostID: "timed-out", ErrorMessage: "timed out after 30s"},
+		{HostID: "stderr", Complete: true, Stderr: "access denied"},
+		{HostID: "incomplete"},
+	} {
+		if err := state.record(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := state.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := readStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || !done["done"] {
+		t.Errorf("recorded %v, want only the completed host", done)
+	}
+	if done, err := readStateFile(filepath.Join(t.TempDir(), "missing")); err != nil || len(done) != 0 {
+		t.Errorf("missing state file = %v, %v", done, err)
+	}
+}
+
+func TestMalformedEnvLines(t *testing.T) {
+	unsetEnv(t, "CS_TEST_GOOD")
+	env := strings.Join([]string{
+		"# credentials",
+		"CLIENT_ID foo",
+		"CS_TEST_GOOD=yes",
+		"=no-key",
+		"",
+		`CS_TEST_OPEN="s3cret`,
+	}, "\n")
+
+	malformed, err := loadEnvFile(writeTempFile(t, ".env", env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(malformed) != "[2 4 6]" {
+		t.Errorf("malformed lines = %v, want [2 4 6]", malformed)
+	}
+	if os.Getenv("CS_TEST_GOOD") != "yes" {
+		t.Error("the valid line after a malformed one was not loaded")
+	}
+
+	// The CLI warns by line number without echoing the line, or fails with -strict-env
+	api := newFakeCrowdStrike(t)
+	cmd := cliCommand(t, api, "-aid", testAID, "-command", "ps")
+	if err := os.WriteFile(filepath.Join(cmd.Dir, ".env"), []byte(env), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := runCommand(t, cmd)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	for _, line := range []int{2, 4, 6} {
+		if want := fmt.Sprintf("Warning: ignoring .env line %d,", line); !strings.Contains(stderr, want) {
+			t.Errorf("stderr is missing %q:\n%s", want, stderr)
+		}
+	}
+	if strings.Contains(stderr, "s3cret") || strings.Contains(stderr, "foo") {
+		t.Errorf("warning echoes the line:\n%s", stderr)
+	}
+
+	cmd = cliCommand(t, api, "-aid", testAID, "-command", "ps", "-strict-env")
+	if err := os.WriteFile(filepath.Join(cmd.Dir, ".env"), []byte(env), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if stdout, _, code := runCommand(t, cmd); code != 1 || !strings.Contains(stdout, "Error: .env line 2 is not a valid KEY=VALUE assignment") {
+		t.Errorf("-strict-env exited %d: %s", code, stdout)
+	}
+	if commands := sentCommands(t, api); len(commands) != 1 {
+		t.Errorf("%d commands sent, want only the run without -strict-env", len(commands))
+	}
+}
+
+func TestEnvEscapes(t *testing.T) {
+	for _, tc := range []struct {
+		value, want string
+	}{
+		{`"line1\nline2"`, "line1\nline2"},
+		{`"quote\"inside"`, `quote"inside`},
+		{`"back\\slash"`, `back\slash`},
+		{`"tab\there" # comment`, "tab\there"},
+		{`"C:\Users\unknown"`, `C:\Users\unknown`},
+		{`'literal\n\"kept'`, `literal\n\"kept`},
+		{`unquoted\n`, `unquoted\n`},
+	} {
+		if got := parseEnvValue(tc.value); got != tc.want {
+			t.Errorf("parseEnvValue(%s) = %q, want %q", tc.value, got, tc.want)
+		}
+	}
+
+	// An escaped quote does not close the value, so the assignment after it is still read
+	unsetEnv(t, "CS_TEST_SECRET")
+	unsetEnv(t, "CS_TEST_NEXT")
+	path := writeTempFile(t, ".env", `CS_TEST_SECRET="a\"b\\"`+"\nCS_TEST_NEXT='x\\y'\n")
+	if malformed, err := loadEnvFile(path); err != nil || len(malformed) != 0 {
+		t.Fatalf("loadEnvFile = %v, %v", malformed, err)
+	}
+	if got := os.Getenv("CS_TEST_SECRET"); got != `a"b\` {
+		t.Errorf("CS_TEST_SECRET = %q", got)
+	}
+	if got := os.Getenv("CS_TEST_NEXT"); got != `x\y` {
+		t.Errorf("CS_TEST_NEXT = %q", got)
+	}
+}
+
+func TestDeleteSessionCommand(t *testing.T) {
+	api := newFakeCrowdStrike(t)
+	api.handle("DELETE "+rtrPath+"/entities/sessions/v1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("session_id") == "gone" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for session, want := range map[string]string{
+		"live": "Deleted session live\n",
+		"gone": "Session gone not found; it was already closed or has expired\n",
+	} {
+		stdout, stderr, code := runCLI(t, api, "-delete-session", session)
+		if code != 0 || stdout != want {
+			t.Errorf("-delete-session %s exited %d with %q, want %q: %s", session, code, stdout, want, stderr)
+		}
+	}
+	if requests := api.recorded("GET", "/devices/"); len(requests) != 0 {
+		t.Errorf("-delete-session searched for hosts: %+v", requests)
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := writeTempFile(t, "credentials", strings.Join([]string{
+		"# CrowdStrike API clients",
+		"[prod]",
+		"client_id = prod-id",
+		`client_secret = "prod-secret"`,
+		"region = us-2",
+		"",
+		"[ staging ]",
+		"; eu tenant",
+		"client_id=staging-id",
+		"client_secret='staging#secret'",
+		"region = eu-1",
+	}, "\n"))
+
+	for name, want := range map[string]credentialProfile{
+		"prod":    {ClientID: "prod-id", ClientSecret: "prod-secret", Region: "us-2"},
+		"staging": {ClientID: "staging-id", ClientSecret: "staging#secret", Region: "eu-1"},
+	} {
+		profile, err := loadProfile(path, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if *profile != want {
+			t.Errorf("%s = %+v, want %+v", name, *profile, want)
+		}
+	}
+	if _, err := loadProfile(path, "dev"); err == nil || !strings.Contains(err.Error(), `profile "dev" not found`) {
+		t.Errorf("missing profile = %v", err)
+	}
+	if _, err := loadProfile(writeTempFile(t, "credentials", "[prod]\nclient_idprod-id\n"), "prod"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("line without = was accepted: %v", err)
+	}
+	if _, err := loadProfile(writeTempFile(t, "credentials", "[prod]\npassword = x\n"), "prod"); err == nil || !strings.Contains(err.Error(), `unknown key "password"`) {
+		t.Errorf("unknown key was accepted: %v", err)
+	}
+
+	// -profile selects the credentials over the environment; without it the environment is used
+	api := newFakeCrowdStrike(t)
+	for _, tc := range []struct {
+		args   []string
+		wantID string
+	}{
+		{[]string{"-profile", "staging"}, "staging-id"},
+		{nil, "test-id"},
+	} {
+		cmd := cliCommand(t, api, append(tc.args, "-aid", testAID, "-command", "ps")...)
+		dir := filepath.Join(cmd.Dir, ".crowdstrike-cli")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(path)
+		if err := os.WriteFile(filepath.Join(dir, "credentials"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, stderr, code := runCommand(t, cmd); code != 0 {
+			t.Fatalf("%v: exit code %d: %s", tc.args, code, stderr)
+		}
+		tokens := api.recorded("POST", "/oauth2/token")
+		form, _ := url.ParseQuery(string(tokens[len(tokens)-1].Body))
+		if form.Get("client_id") != tc.wantID {
+			t.Errorf("%v authenticated as %q, want %q", tc.args, form.Get("client_id"), tc.wantID)
+		}
+	}
+
+	if stdout, _, code := runCLI(t, api, "-profile", "dev", "-aid", testAID, "-command", "ps"); code != 1 || !strings.Contains(stdout, "Error: loading profile") {
+		t.Errorf("unknown profile exited %d: %s", code, stdout)
+	}
+}
+
+func TestCommandStringFromStdin(t *testing.T) {
+	for _, tc := range []struct {
+		input, want, base, endpoint string
+	}{
+		{`reg query "HKLM\Software\My App" /v "Display Name"` + "\r\n\n", `reg query "HKLM\Software\My App" /v "Display Name"`, "reg", "batch-command/v1"},
+		{"runscript -Raw=```Get-Process | ? { $_.Name -eq 'x' }\nexit 0``` -Timeout=60\n", "runscript -Raw=```Get-Process | ? { $_.Name -eq 'x' }\nexit 0``` -Timeout=60", "runscript", "batch-admin-command/v1"},
+	} {
+		api := newFakeCrowdStrike(t)
+		cmd := cliCommand(t, api, "-aid", testAID, "-command-string", "-")
+		cmd.Stdin = strings.NewReader(tc.input)
+		if _, stderr, code := runCommand(t, cmd); code != 0 {
+			t.Fatalf("exit code %d: %s", code, stderr)
+		}
+		commands := sentCommands(t, api)
+		if len(commands) != 1 {
+			t.Fatalf("sent %+v, want one command", commands)
+		}
+		if c := commands[0]; c.CommandString != tc.want || c.BaseCommand != tc.base || c.Endpoint != tc.endpoint {
+			t.Errorf("sent %+v, want %q as %s on %s", c, tc.want, tc.base, tc.endpoint)
+		}
+	}
+
+	api := newFakeCrowdStrike(t)
+	cmd := cliCommand(t, api, "-aid", testAID, "-command-string", "-")
+	cmd.Stdin = strings.NewReader("\n\n")
+	if stdout, _, code := runCommand(t, cmd); code != 1 || !strings.Contains(stdout, "- is empty") {
+		t.Errorf("empty stdin exited %d: %s", code, stdout)
+	}
+	if stdout, _, code := runCLI(t, api, "-aid", testAID, "-command-string", "-", "-command", "ps"); code != 1 || !strings.Contains(stdout, "cannot be combined") {
+		t.Errorf("-command-string with -command exited %d: %s", code, stdout)
+	}
+}
+
+func TestFailuresOnly(t *testing.T) {
+	ok, stderrHost, errored, offline := fmt.Sprintf("%032x", 1), fmt.Sprintf("%032x", 2), fmt.Sprintf("%032x", 3), fmt.Sprintf("%032x", 4)
+	api := newFakeCrowdStrike(t)
+	api.handle("POST "+rtrPath+"/combined/batch-command/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"combined": map[string]interface{}{"resources": map[string]interface{}{
+			ok:         map[string]interface{}{"complete": true, "stdout": "all good"},
+			stderrHost: map[string]interface{}{"complete": true, "stdout": "partial listing", "stderr": "access denied"},
+			errored:    map[string]interface{}{"complete": true, "errors": []map[string]interface{}{{"code": 40401, "message": "command failed"}}},
+		}}})
+	})
+
+	stdout, stderr, _ := runCLI(t, api, "-aid", ok, "-aid", stderrHost, "-aid", errored, "-aid", offline, "-command", "ls", "-failures-only")
+	output := stdout + stderr
+	if strings.Contains(output, "all good") || strings.Contains(output, "name-"+ok) {
+		t.Errorf("the successful host was printed:\n%s", output)
+	}
+	for _, want := range []string{"partial listing", "access denied", "command failed", offline} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output is missing %q:\n%s", want, output)
+		}
+	}
+	if !strings.Contains(stderr, "1 succeeded, 2 failed, 1 offline") || !strings.Contains(stderr, ", 1 successful hidden") {
+		t.Errorf("summary = %q, want the hidden success counted", stderr)
+	}
+
+	// Without the flag the successful host is printed and nothing is reported hidden
+	stdout, stderr, _ = runCLI(t, api, "-aid", ok, "-aid", errored, "-command", "ls")
+	if !strings.Contains(stdout, "all good") || strings.Contains(stderr, "hidden") {
+		t.Errorf("without -failures-only:\n%s%s", stdout, stderr)
+	}
+}
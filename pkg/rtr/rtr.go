@@ -0,0 +1,2871 @@
+// Package rtr is a client for the CrowdStrike Real-Time Response batch API
+package rtr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIErrorDetail is a single entry of the CrowdStrike error envelope
+type APIErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIError is returned when the CrowdStrike API responds with an unexpected status
+type APIError struct {
+	Op         string
+	StatusCode int
+	Errors     []APIErrorDetail
+	Body       []byte
+	// TraceID identifies the request to CrowdStrike support
+	TraceID string
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	msg := string(e.Body)
+	if len(e.Errors) > 0 {
+		msg = e.Errors[0].Message
+	}
+	if e.TraceID != "" {
+		return fmt.Sprintf("%s failed (HTTP %d, trace ID %s): %s", e.Op, e.StatusCode, e.TraceID, msg)
+	}
+	return fmt.Sprintf("%s failed (HTTP %d): %s", e.Op, e.StatusCode, msg)
+}
+
+// traceIDHeader carries the request ID CrowdStrike support asks for
+const traceIDHeader = "X-Cs-Traceid"
+
+// redactedValue replaces sensitive values in logs and errors
+const redactedValue = "[REDACTED]"
+
+var (
+	clientSecretPattern = regexp.MustCompile(`(?i)(client_secret["']?\s*[=:]\s*["']?)[^&"'\s]+`)
+	accessTokenPattern  = regexp.MustCompile(`(?i)("access_token"\s*:\s*")[^"]+`)
+	bearerPattern       = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+)
+
+// redactSecrets masks the given secret values and any credential-shaped substrings in s
+func redactSecrets(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redactedValue)
+		}
+	}
+
+	s = clientSecretPattern.ReplaceAllString(s, "${1}"+redactedValue)
+	s = accessTokenPattern.ReplaceAllString(s, "${1}"+redactedValue)
+	s = bearerPattern.ReplaceAllString(s, "${1}"+redactedValue)
+
+	return s
+}
+
+// redact masks this client's secret and bearer token in s
+func (c *RTRClient) redact(s string) string {
+	token := strings.TrimPrefix(c.authHeader(), "Bearer ")
+	c.headersMu.RLock()
+	secret := c.clientSecret
+	c.headersMu.RUnlock()
+	return redactSecrets(s, secret, token)
+}
+
+// newAPIError builds an APIError from a response, parsing the standard error envelope.
+// The body is redacted since it is embedded in the error message
+func (c *RTRClient) newAPIError(op string, resp *http.Response) *APIError {
+	raw, _ := io.ReadAll(resp.Body)
+	body := []byte(c.redact(string(raw)))
+
+	apiErr := &APIError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Body:       body,
+		TraceID:    resp.Header.Get(traceIDHeader),
+	}
+
+	var envelope struct {
+		Meta struct {
+			TraceID string `json:"trace_id"`
+		} `json:"meta"`
+		Errors []APIErrorDetail `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &envelope); err == nil {
+		apiErr.Errors = envelope.Errors
+		// Some gateways drop the header; the envelope carries the same ID
+		if apiErr.TraceID == "" {
+			apiErr.TraceID = envelope.Meta.TraceID
+		}
+	}
+
+	return apiErr
+}
+
+// RTRClient represents a CrowdStrike Real-Time Response client
+type RTRClient struct {
+	authURL string
+	apiURL  string
+	baseURL string
+	// credentials supplies the client ID and secret each time a token is requested
+	credentials CredentialProvider
+	// clientID and clientSecret are the credentials of the current token
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+	headers      map[string]string
+	tokenExpiry  time.Time
+	// tokenScopes lists the scopes granted to the token; nil when the token response omitted them
+	tokenScopes []string
+	// headersMu guards the credentials of the current token, headers, tokenExpiry and
+	// tokenScopes, which token refresh rewrites while workers read them
+	headersMu sync.RWMutex
+	// authMu keeps concurrent workers from refreshing an expiring token more than once
+	authMu sync.Mutex
+	// memberCID scopes tokens to a child tenant for MSSP (Flight Control) parents
+	memberCID string
+	// tokenCachePath is where tokens are cached between runs; empty disables caching
+	tokenCachePath string
+	// hostFields limits host detail lookups to these device fields; empty requests the full record
+	hostFields []string
+
+	// limiter paces requests across all goroutines sharing the client; nil means unlimited
+	limiter *rateLimiter
+
+	// stats counts requests for Stats
+	stats clientStats
+
+	// activeSessions maps open batch IDs to their per-host session IDs
+	activeSessions map[string][]string
+	sessionsMu     sync.Mutex
+
+	// MaxRetries is the number of times a request is retried on network errors, 429 or 5xx responses.
+	// Commands that change host state and file uploads are only retried when they provably never ran
+	MaxRetries int
+	// RetryDelay is the base delay between retries, doubled after each attempt
+	RetryDelay time.Duration
+	// RefreshInterval is how often batch sessions are refreshed while waiting on commands
+	RefreshInterval time.Duration
+	// Logger receives debug output for requests, responses and retries
+	Logger *slog.Logger
+	// IncludeHidden makes HostSearch also return hosts hidden in the console. No FQL clause
+	// selects them; they are fetched from the devices-hidden query endpoint with the same filter
+	IncludeHidden bool
+	// QueueOffline asks batch sessions to queue commands for offline hosts so they run on reconnect
+	QueueOffline bool
+	// OnHostResult, when set, is called once per host as soon as its result is complete while
+	// WaitForBatchCommand polls; it may be called from several goroutines at once
+	OnHostResult func(HostResult)
+}
+
+// EndpointStats counts the requests a client sent to one endpoint
+type EndpointStats struct {
+	Method string
+	Path   string
+	// Responses counts responses by HTTP status code, including retried ones
+	Responses map[int]int
+	// Errors counts requests that got no response, such as network failures and timeouts
+	Errors int
+	// Duration is the total time spent waiting on the requests
+	Duration time.Duration
+}
+
+// ClientStats is a snapshot of the requests a client has made
+type ClientStats struct {
+	// Endpoints is sorted by path, then method
+	Endpoints []EndpointStats
+	// Authentications counts token requests, and AuthDuration is their total time including retries
+	Authentications int
+	AuthDuration    time.Duration
+}
+
+// clientStats accumulates request counts and timings across goroutines
+type clientStats struct {
+	mu           sync.Mutex
+	endpoints    map[string]*EndpointStats
+	auths        int
+	authDuration time.Duration
+}
+
+// recordRequest counts one request attempt; status is 0 when no response was received
+func (s *clientStats) recordRequest(method, path string, status int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.endpoints == nil {
+		s.endpoints = make(map[string]*EndpointStats)
+	}
+	key := method + " " + path
+	endpoint, ok := s.endpoints[key]
+	if !ok {
+		endpoint = &EndpointStats{Method: method, Path: path, Responses: make(map[int]int)}
+		s.endpoints[key] = endpoint
+	}
+	if status == 0 {
+		endpoint.Errors++
+	} else {
+		endpoint.Responses[status]++
+	}
+	endpoint.Duration += d
+}
+
+// recordAuth counts one token request
+func (s *clientStats) recordAuth(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.auths++
+	s.authDuration += d
+}
+
+// Stats returns the request counts and timings accumulated by the client
+func (c *RTRClient) Stats() ClientStats {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	stats := ClientStats{Authentications: c.stats.auths, AuthDuration: c.stats.authDuration}
+	for _, endpoint := range c.stats.endpoints {
+		copied := *endpoint
+		copied.Responses = make(map[int]int, len(endpoint.Responses))
+		for code, n := range endpoint.Responses {
+			copied.Responses[code] = n
+		}
+		stats.Endpoints = append(stats.Endpoints, copied)
+	}
+	sort.Slice(stats.Endpoints, func(i, j int) bool {
+		a, b := stats.Endpoints[i], stats.Endpoints[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Method < b.Method
+	})
+	return stats
+}
+
+// tokenRefreshWindow is how long before expiry the token is proactively refreshed
+const tokenRefreshWindow = 60 * time.Second
+
+// regionBaseURLs maps CrowdStrike cloud regions to their API base URLs
+var regionBaseURLs = map[string]string{
+	"us-1":     "https://api.crowdstrike.com",
+	"us-2":     "https://api.us-2.crowdstrike.com",
+	"eu-1":     "https://api.eu-1.crowdstrike.com",
+	"us-gov-1": "https://api.laggar.gcw.crowdstrike.com",
+}
+
+// RegionBaseURL returns the API base URL for a CrowdStrike cloud region
+func RegionBaseURL(region string) (string, error) {
+	region = strings.ToLower(strings.TrimSpace(region))
+	if region == "" {
+		region = "us-1"
+	}
+
+	baseURL, ok := regionBaseURLs[region]
+	if !ok {
+		return "", fmt.Errorf("unknown region %q (expected us-1, us-2, eu-1 or us-gov-1)", region)
+	}
+
+	return baseURL, nil
+}
+
+// RegionForURL returns the region served by baseURL, or "custom" for other hosts
+func RegionForURL(baseURL string) string {
+	for region, regionURL := range regionBaseURLs {
+		if strings.TrimSuffix(baseURL, "/") == regionURL {
+			return region
+		}
+	}
+	return "custom"
+}
+
+// NewRTRClient creates a new RTRClient instance
+func NewRTRClient(clientID, clientSecret, baseURL string, verifyCert bool) *RTRClient {
+	opts := []Option{WithBaseURL(baseURL)}
+	if !verifyCert {
+		opts = append(opts, WithInsecureSkipVerify())
+	}
+
+	// Neither option can fail, so the error is always nil
+	c, _ := NewRTRClientWithOptions(clientID, clientSecret, opts...)
+	return c
+}
+
+// Option configures an RTRClient created by NewRTRClientWithOptions
+type Option func(*RTRClient) error
+
+// CredentialProvider supplies API credentials, e.g. from a secrets manager. Credentials is
+// called for every token request, so rotated secrets are picked up on the next refresh
+type CredentialProvider interface {
+	Credentials() (id, secret string, err error)
+}
+
+// StaticCredentials is a CredentialProvider that always returns the same client ID and secret
+type StaticCredentials struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// Credentials returns the fixed client ID and secret
+func (s StaticCredentials) Credentials() (string, string, error) {
+	return s.ClientID, s.ClientSecret, nil
+}
+
+// WithCredentialProvider obtains credentials from p instead of the fixed client ID and secret
+func WithCredentialProvider(p CredentialProvider) Option {
+	return func(c *RTRClient) error {
+		if p == nil {
+			return fmt.Errorf("credential provider must not be nil")
+		}
+		c.credentials = p
+		return nil
+	}
+}
+
+// NewRTRClientWithOptions creates an RTRClient for the us-1 cloud with a 30 second timeout,
+// then applies opts in order. clientID and clientSecret are ignored when opts include
+// WithCredentialProvider
+func NewRTRClientWithOptions(clientID, clientSecret string, opts ...Option) (*RTRClient, error) {
+	// Start from the default transport so connection pooling and compression defaults are kept
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	c := &RTRClient{
+		credentials:  StaticCredentials{ClientID: clientID, ClientSecret: clientSecret},
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: transport,
+		},
+		headers:         make(map[string]string),
+		MaxRetries:      3,
+		RetryDelay:      500 * time.Millisecond,
+		RefreshInterval: SessionRefreshInterval,
+		Logger:          slog.Default(),
+	}
+	c.setBaseURL("https://api.crowdstrike.com")
+
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// setBaseURL points the OAuth, host and RTR endpoints at baseURL
+func (c *RTRClient) setBaseURL(baseURL string) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	c.authURL = baseURL
+	c.apiURL = baseURL
+	c.baseURL = baseURL + "/real-time-response"
+}
+
+// WithBaseURL sends requests to an explicit API base URL; an empty URL keeps the default
+func WithBaseURL(baseURL string) Option {
+	return func(c *RTRClient) error {
+		if baseURL != "" {
+			c.setBaseURL(baseURL)
+		}
+		return nil
+	}
+}
+
+// WithRegion sends requests to the API base URL of a CrowdStrike cloud region
+func WithRegion(region string) Option {
+	return func(c *RTRClient) error {
+		baseURL, err := RegionBaseURL(region)
+		if err != nil {
+			return err
+		}
+		c.setBaseURL(baseURL)
+		return nil
+	}
+}
+
+// WithTimeout sets the HTTP timeout applied to each request
+func WithTimeout(d time.Duration) Option {
+	return func(c *RTRClient) error {
+		c.SetTimeout(d)
+		return nil
+	}
+}
+
+// WithInsecureSkipVerify disables TLS certificate verification. Only use it when explicitly
+// requested, e.g. behind a TLS-intercepting proxy in a lab environment
+func WithInsecureSkipVerify() Option {
+	return func(c *RTRClient) error {
+		transport, ok := c.httpClient.Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("certificate verification cannot be disabled on a custom transport")
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		return nil
+	}
+}
+
+// WithClientCertificate presents the certificate and key in the given PEM files on every
+// connection, for deployments whose proxies require mutual TLS in addition to OAuth
+func WithClientCertificate(certFile, keyFile string) Option {
+	return func(c *RTRClient) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate: %w", err)
+		}
+		transport, ok := c.httpClient.Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("a client certificate cannot be added to a custom transport")
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.Certificates = append(transport.TLSClientConfig.Certificates, cert)
+		return nil
+	}
+}
+
+// WithHTTPClient replaces the HTTP client used for every request. Options applied earlier
+// that configure the default client, such as WithTimeout, do not carry over
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *RTRClient) error {
+		if httpClient == nil {
+			return fmt.Errorf("HTTP client must not be nil")
+		}
+		c.SetHTTPClient(httpClient)
+		return nil
+	}
+}
+
+// SetTimeout sets the HTTP timeout applied to each request, including reading the response body.
+// Batch command calls, which the API holds open while hosts run the command, get at least the
+// command timeout instead
+func (c *RTRClient) SetTimeout(d time.Duration) {
+	c.httpClient.Timeout = d
+}
+
+// SetHTTPClient replaces the HTTP client used for every request, e.g. to record requests in
+// tests or to supply a custom transport. Later SetTimeout calls apply to it
+func (c *RTRClient) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+// SetAuthURL sends OAuth token requests to a different host than the rest of the API,
+// for deployments that front the token endpoint through a separate gateway
+func (c *RTRClient) SetAuthURL(authURL string) {
+	c.authURL = strings.TrimSuffix(authURL, "/")
+}
+
+// memberCIDPattern matches a CID of 32 hex characters with an optional two-character checksum suffix
+var memberCIDPattern = regexp.MustCompile(`^([0-9a-fA-F]{32})(-[0-9a-fA-F]{2})?$`)
+
+// SetMemberCID scopes every subsequent request to a child CID. The CID is sent with the
+// token request, so RTR and host calls made with the resulting token act on that tenant.
+func (c *RTRClient) SetMemberCID(cid string) error {
+	match := memberCIDPattern.FindStringSubmatch(strings.TrimSpace(cid))
+	if match == nil {
+		return fmt.Errorf("invalid CID %q: expected 32 hex characters with an optional -XX checksum", cid)
+	}
+	c.memberCID = strings.ToLower(match[1])
+	return nil
+}
+
+// SetHostFields limits GetHostDetails to the named device fields, which are kept in each
+// HostInfo's Fields. device_id is always requested; an empty list requests full records
+func (c *RTRClient) SetHostFields(fields []string) error {
+	seen := map[string]bool{"device_id": true}
+	requested := []string{"device_id"}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if !HostDetailFields[field] {
+			return fmt.Errorf("unknown host field %q", field)
+		}
+		if !seen[field] {
+			seen[field] = true
+			requested = append(requested, field)
+		}
+	}
+	if len(fields) == 0 {
+		requested = nil
+	}
+	c.hostFields = requested
+	return nil
+}
+
+// SetRateLimit caps the client at perSecond requests per second across all goroutines;
+// zero or less removes the limit
+func (c *RTRClient) SetRateLimit(perSecond float64) {
+	if perSecond <= 0 {
+		c.limiter = nil
+		return
+	}
+	c.limiter = &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// rateLimiter spaces requests evenly so no more than one is sent per interval
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until the next request slot is available or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// SetProxy routes all requests through the given proxy URL instead of the environment settings
+func (c *RTRClient) SetProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy URL %q: scheme and host are required", proxyURL)
+	}
+
+	transport, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("proxy cannot be set on a custom transport")
+	}
+	transport.Proxy = http.ProxyURL(u)
+
+	return nil
+}
+
+// ErrCredentialsRejected is returned when the token endpoint refuses the client ID or secret
+var ErrCredentialsRejected = errors.New("credentials rejected: check CLIENT_ID/CLIENT_SECRET and that the API client is still active")
+
+// rejectedCredentialMarkers are fragments of the OAuth and CrowdStrike error bodies sent for
+// an unknown client, a wrong secret or a disabled API client
+var rejectedCredentialMarkers = []string{"invalid_client", "unauthorized_client", "access_denied", "invalid client", "access denied"}
+
+// credentialsRejected reports whether a failed token request was refused because of the
+// credentials rather than, say, an outage or a bad member CID
+func credentialsRejected(apiErr *APIError) bool {
+	switch apiErr.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+	default:
+		return false
+	}
+
+	body := strings.ToLower(string(apiErr.Body))
+	for _, marker := range rejectedCredentialMarkers {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate authenticates to CrowdStrike API using id and secret
+func (c *RTRClient) Authenticate() error {
+	return c.AuthenticateContext(context.Background())
+}
+
+// AuthenticateContext is like Authenticate but honors ctx for cancellation and deadlines
+func (c *RTRClient) AuthenticateContext(ctx context.Context) error {
+	clientID, clientSecret, err := c.credentials.Credentials()
+	if err != nil {
+		return fmt.Errorf("getting credentials: %w", err)
+	}
+	if clientID == "" || clientSecret == "" {
+		return fmt.Errorf("getting credentials: client ID and secret must not be empty")
+	}
+	c.headersMu.Lock()
+	c.clientID, c.clientSecret = clientID, clientSecret
+	c.headersMu.Unlock()
+
+	if c.tokenCachePath != "" && c.loadCachedToken(clientID) {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { c.stats.recordAuth(time.Since(start)) }()
+
+	payload := url.Values{}
+	payload.Set("client_id", clientID)
+	payload.Set("client_secret", clientSecret)
+	if c.memberCID != "" {
+		payload.Set("member_cid", c.memberCID)
+	}
+
+	body := []byte(payload.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", c.authURL+"/oauth2/token", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.doWithRetry(req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		apiErr := c.newAPIError("authentication", resp)
+		if credentialsRejected(apiErr) {
+			return fmt.Errorf("%w (%w)", ErrCredentialsRejected, apiErr)
+		}
+		return apiErr
+	}
+
+	if err := c.checkJSONResponse("authentication", resp); err != nil {
+		return err
+	}
+
+	var authResp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		Scope       string `json:"scope"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
+		return err
+	}
+
+	// Only bearer tokens are supported; the scheme is matched case-insensitively as RFC 6749 requires
+	if authResp.TokenType != "" && !strings.EqualFold(authResp.TokenType, "bearer") {
+		return fmt.Errorf("authentication: unsupported token type %q (expected bearer)", authResp.TokenType)
+	}
+	if authResp.AccessToken == "" {
+		return fmt.Errorf("authentication: response did not include an access token")
+	}
+
+	var scopes []string
+	if authResp.Scope != "" {
+		scopes = strings.Fields(authResp.Scope)
+	}
+	c.setToken(authResp.AccessToken, time.Now().Add(time.Duration(authResp.ExpiresIn)*time.Second), scopes)
+
+	if c.tokenCachePath != "" {
+		if err := c.saveCachedToken(); err != nil {
+			c.Logger.Warn("could not cache token", "path", c.tokenCachePath, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// checkJSONResponse rejects responses that are not JSON, such as a proxy's HTML login page,
+// with an error naming the content type and the first line of the body
+func (c *RTRClient) checkJSONResponse(op string, resp *http.Response) error {
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(string(raw)), "\n")
+	return fmt.Errorf("%s: expected a JSON response but got content type %q (is a proxy intercepting the request?): %s",
+		op, contentType, c.redact(strings.TrimSpace(firstLine)))
+}
+
+// setToken installs a bearer token, its expiry and its granted scopes on the client
+func (c *RTRClient) setToken(accessToken string, expiry time.Time, scopes []string) {
+	c.headersMu.Lock()
+	defer c.headersMu.Unlock()
+
+	c.headers["Authorization"] = "Bearer " + accessToken
+	c.headers["token_type"] = "bearer"
+	c.headers["Content-Type"] = "application/json"
+	c.tokenExpiry = expiry
+	c.tokenScopes = scopes
+}
+
+// setHeader sets a header sent with every API request
+func (c *RTRClient) setHeader(key, value string) {
+	c.headersMu.Lock()
+	defer c.headersMu.Unlock()
+
+	c.headers[key] = value
+}
+
+// authHeader returns the current Authorization header, or "" before authentication
+func (c *RTRClient) authHeader() string {
+	c.headersMu.RLock()
+	defer c.headersMu.RUnlock()
+
+	return c.headers["Authorization"]
+}
+
+// headerSnapshot returns a copy of the request headers that is safe to range over
+// while another goroutine refreshes the token
+func (c *RTRClient) headerSnapshot() map[string]string {
+	c.headersMu.RLock()
+	defer c.headersMu.RUnlock()
+
+	headers := make(map[string]string, len(c.headers))
+	for k, v := range c.headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+// tokenValid reports whether a token is installed and not within the refresh window
+func (c *RTRClient) tokenValid() bool {
+	c.headersMu.RLock()
+	defer c.headersMu.RUnlock()
+
+	return c.headers["Authorization"] != "" && time.Until(c.tokenExpiry) > tokenRefreshWindow
+}
+
+// cachedToken is the on-disk form of a cached OAuth token
+type cachedToken struct {
+	ClientID    string    `json:"client_id"`
+	AuthURL     string    `json:"auth_url"`
+	MemberCID   string    `json:"member_cid,omitempty"`
+	AccessToken string    `json:"access_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Scopes      []string  `json:"scopes,omitempty"`
+}
+
+// DefaultTokenCachePath returns ~/.crowdstrike-cli/token.json, or "" if the home directory is unknown
+func DefaultTokenCachePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".crowdstrike-cli", "token.json")
+}
+
+// SetTokenCache enables reusing OAuth tokens across runs through the given file
+func (c *RTRClient) SetTokenCache(path string) {
+	c.tokenCachePath = path
+}
+
+// loadCachedToken installs the cached token if it belongs to clientID and is not near expiry
+func (c *RTRClient) loadCachedToken(clientID string) bool {
+	content, err := os.ReadFile(c.tokenCachePath)
+	if err != nil {
+		return false
+	}
+
+	var cached cachedToken
+	if err := json.Unmarshal(content, &cached); err != nil {
+		return false
+	}
+
+	if cached.ClientID != clientID || cached.AuthURL != c.authURL || cached.MemberCID != c.memberCID || cached.AccessToken == "" {
+		return false
+	}
+	if time.Until(cached.ExpiresAt) <= tokenRefreshWindow {
+		return false
+	}
+
+	c.Logger.Debug("using cached token", "path", c.tokenCachePath, "expires_at", cached.ExpiresAt)
+	c.setToken(cached.AccessToken, cached.ExpiresAt, cached.Scopes)
+
+	return true
+}
+
+// saveCachedToken writes the current token to the cache file, readable only by the owner
+func (c *RTRClient) saveCachedToken() error {
+	c.headersMu.RLock()
+	cached := cachedToken{
+		ClientID:    c.clientID,
+		AuthURL:     c.authURL,
+		MemberCID:   c.memberCID,
+		AccessToken: strings.TrimPrefix(c.headers["Authorization"], "Bearer "),
+		ExpiresAt:   c.tokenExpiry,
+		Scopes:      c.tokenScopes,
+	}
+	c.headersMu.RUnlock()
+
+	content, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.tokenCachePath), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.tokenCachePath, content, 0600); err != nil {
+		return err
+	}
+
+	// WriteFile keeps the mode of an existing file, so tighten it explicitly
+	return os.Chmod(c.tokenCachePath, 0600)
+}
+
+// retryPolicy decides which failed attempts of a request are sent again
+type retryPolicy int
+
+const (
+	// retryFailures retries network errors, timeouts, 429 and 5xx responses. It suits reads and
+	// calls that are safe to repeat, such as token requests and session setup
+	retryFailures retryPolicy = iota
+	// retryUnsent only retries attempts that provably never ran: a connection that could not be
+	// established, a 429, or a 503 without a body. Calls that change host state use it, since a
+	// timeout or 5xx does not tell whether the server already carried them out
+	retryUnsent
+)
+
+// doWithRetry sends the request, retrying network errors and 5xx responses with exponential backoff
+// and honoring Retry-After on 429 responses. body is the request payload; it is re-sent in full
+// on every attempt and through req.GetBody on redirects
+func (c *RTRClient) doWithRetry(req *http.Request, body []byte) (*http.Response, error) {
+	return c.send(c.httpClient, req, body, retryFailures)
+}
+
+// send is doWithRetry with an explicit HTTP client and retry policy
+func (c *RTRClient) send(client *http.Client, req *http.Request, body []byte, policy retryPolicy) (*http.Response, error) {
+	if body != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.ContentLength = int64(len(body))
+	}
+
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		// A consumed body would otherwise be sent empty on the retry
+		if req.GetBody != nil && (body != nil || attempt > 0) {
+			rewound, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = rewound
+		}
+
+		reqURL := c.redact(req.URL.String())
+		c.Logger.Debug("http request", "method", req.Method, "url", reqURL, "attempt", attempt+1)
+
+		if c.limiter != nil {
+			if err := c.limiter.wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+
+		// Asking for gzip explicitly turns off the transport's transparent decompression, so
+		// responses are decompressed below whatever transport is in use
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			if err = decompressResponse(resp); err != nil {
+				resp.Body.Close()
+				resp = nil
+			}
+		}
+		c.stats.recordRequest(req.Method, req.URL.Path, status, time.Since(start))
+		if err != nil {
+			c.Logger.Debug("http request failed", "method", req.Method, "url", reqURL, "error", c.redact(err.Error()))
+		} else {
+			c.Logger.Debug("http response", "method", req.Method, "url", reqURL, "status", resp.StatusCode, "trace_id", resp.Header.Get(traceIDHeader))
+		}
+
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if attempt >= c.MaxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if policy == retryUnsent && !neverRan(resp, err) {
+			c.Logger.Debug("not retrying request that may have run", "method", req.Method, "url", reqURL)
+			return resp, err
+		}
+
+		wait := delay
+		if err == nil {
+			// Rate limited responses tell us how long to back off
+			if resp.StatusCode == http.StatusTooManyRequests {
+				if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+					wait = d
+				}
+			}
+			resp.Body.Close()
+		}
+
+		c.Logger.Debug("retrying request", "method", req.Method, "url", reqURL, "attempt", attempt+1, "wait", wait)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// neverRan reports whether a failed attempt was certainly not carried out by the API: the
+// connection could not be established, the request was rate limited, or a 503 came back
+// without a body, which is how the gateway turns requests away before they reach the service.
+// A body read to check for emptiness is put back so the response can still be reported
+func neverRan(resp *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		return len(bytes.TrimSpace(raw)) == 0
+	}
+	return false
+}
+
+// decompressResponse replaces a gzip-encoded response body with its decompressed content
+func decompressResponse(resp *http.Response) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("decompressing response: %w", err)
+	}
+	resp.Body = &gzipBody{Reader: reader, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// gzipBody reads decompressed content and closes the underlying response body
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the gzip reader and the response body
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// parseRetryAfter parses a Retry-After header in either delta-seconds or HTTP-date form
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+
+	return 0, false
+}
+
+// ensureAuthenticated re-authenticates when the token is missing or close to expiry
+func (c *RTRClient) ensureAuthenticated(ctx context.Context) error {
+	if c.tokenValid() {
+		return nil
+	}
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	// Another worker may have refreshed the token while this one waited
+	if c.tokenValid() {
+		return nil
+	}
+	return c.AuthenticateContext(ctx)
+}
+
+// Ping authenticates and runs a single-result host query to confirm that the
+// credentials work and carry the Hosts read scope
+func (c *RTRClient) Ping(ctx context.Context) error {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return err
+	}
+	_, _, _, err := c.hostSearchPage(ctx, devicesQueryPath, "", "", 1)
+	return err
+}
+
+// SelectByFields maps host selectors to their FQL device fields
+var SelectByFields = map[string]string{
+	"hostname":      "hostname",
+	"device_id":     "device_id",
+	"local_ip":      "local_ip",
+	"external_ip":   "external_ip",
+	"platform_name": "platform_name",
+	"tag":           "tags",
+}
+
+// fqlString quotes a value for an FQL filter, escaping the single quotes it contains
+func fqlString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+}
+
+// CriteriaFilter builds an FQL filter matching a field against one value, or against
+// any of a comma-separated list of values
+func CriteriaFilter(field, criteria string) string {
+	var values []string
+	for _, v := range strings.Split(criteria, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, fqlString(v))
+		}
+	}
+
+	if len(values) == 1 {
+		return fmt.Sprintf("%s:%s", field, values[0])
+	}
+	return fmt.Sprintf("%s:[%s]", field, strings.Join(values, ","))
+}
+
+// JoinFilters combines FQL filters so that all of them must match, skipping empty ones
+func JoinFilters(filters ...string) string {
+	var parts []string
+	for _, f := range filters {
+		if f != "" {
+			parts = append(parts, f)
+		}
+	}
+	return strings.Join(parts, "+")
+}
+
+// platformNames maps platform selectors to their FQL platform_name values
+var platformNames = map[string]string{
+	"windows": "Windows",
+	"linux":   "Linux",
+	"mac":     "Mac",
+}
+
+// SeenWithinFilter returns the FQL clause matching hosts last seen within d, such as
+// last_seen:>'now-1h', or "" when d is zero
+func SeenWithinFilter(d time.Duration) (string, error) {
+	if d == 0 {
+		return "", nil
+	}
+	if d < time.Minute || d%time.Minute != 0 {
+		return "", fmt.Errorf("invalid last-seen window %s: must be a positive whole number of minutes", d)
+	}
+
+	// FQL date math takes a single unit, so use the largest one that divides the window
+	window := fmt.Sprintf("%dm", d/time.Minute)
+	switch {
+	case d%(24*time.Hour) == 0:
+		window = fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		window = fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("last_seen:>'now-%s'", window), nil
+}
+
+// PlatformFilter returns the FQL clause restricting hosts to platform, or "" for any platform
+func PlatformFilter(platform string) (string, error) {
+	if platform == "" {
+		return "", nil
+	}
+	name, ok := platformNames[strings.ToLower(platform)]
+	if !ok {
+		return "", fmt.Errorf("unknown platform %q (expected windows, linux or mac)", platform)
+	}
+	return CriteriaFilter("platform_name", name), nil
+}
+
+// hostSearchPageSize is the maximum number of IDs the devices query endpoint returns per page
+const hostSearchPageSize = 5000
+
+// HostSearch searches for hosts in your environment - Returns a list of agent IDs.
+// When both criteria and rawFilter are given, hosts must match both. Results are paginated until all matches are collected; limit caps the total when greater than 0
+func (c *RTRClient) HostSearch(criteria, criteriaType, rawFilter string, limit int) ([]string, error) {
+	return c.HostSearchContext(context.Background(), criteria, criteriaType, rawFilter, limit)
+}
+
+// HostSearchContext is like HostSearch but honors ctx for cancellation and deadlines.
+// With IncludeHidden set, matching hidden hosts follow the visible ones
+func (c *RTRClient) HostSearchContext(ctx context.Context, criteria, criteriaType, rawFilter string, limit int) ([]string, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	filter := rawFilter
+	if criteria != "" && criteriaType != "" {
+		filter = JoinFilters(CriteriaFilter(criteriaType, criteria), rawFilter)
+	}
+
+	hosts, err := c.hostSearchAll(ctx, devicesQueryPath, filter, limit, nil)
+	if err != nil || !c.IncludeHidden || (limit > 0 && len(hosts) >= limit) {
+		return hosts, err
+	}
+
+	// Hidden hosts are only returned by their own query endpoint, which takes the same filter
+	remaining := 0
+	if limit > 0 {
+		remaining = limit - len(hosts)
+	}
+	seen := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		seen[host] = true
+	}
+	hidden, err := c.hostSearchAll(ctx, hiddenDevicesQueryPath, filter, remaining, seen)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(hosts, hidden...), nil
+}
+
+// Host query endpoints; hidden hosts are left out of the devices query. The scroll endpoint
+// pages with a token rather than a numeric offset, so it is not capped at 10,000 matches
+const (
+	devicesQueryPath       = "/devices/queries/devices-scroll/v1"
+	hiddenDevicesQueryPath = "/devices/queries/devices-hidden/v1"
+)
+
+// hostSearchAll pages through a host query endpoint, collecting agent IDs not in skip until
+// every match is collected or limit (when greater than 0) is reached. Each page is requested
+// with the token the previous one returned; an endpoint that returns none, such as the hidden
+// hosts query, is paged by the number of IDs fetched so far
+func (c *RTRClient) hostSearchAll(ctx context.Context, path, filter string, limit int, skip map[string]bool) ([]string, error) {
+	var hosts []string
+	offset := ""
+	fetched := 0
+	for {
+		pageSize := hostSearchPageSize
+		if limit > 0 && limit-len(hosts) < pageSize {
+			pageSize = limit - len(hosts)
+		}
+
+		page, token, total, err := c.hostSearchPage(ctx, path, filter, offset, pageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, host := range page {
+			if !skip[host] && (limit <= 0 || len(hosts) < limit) {
+				hosts = append(hosts, host)
+			}
+		}
+		fetched += len(page)
+
+		if len(page) == 0 || fetched >= total || (limit > 0 && len(hosts) >= limit) {
+			break
+		}
+		offset = token
+		if offset == "" {
+			offset = strconv.Itoa(fetched)
+		}
+	}
+
+	return hosts, nil
+}
+
+// hostSearchPage fetches a single page of agent IDs from a host query endpoint starting at
+// offset, which is left out when empty. It returns the page, the token for the next page
+// when the endpoint pages by token, and the total match count
+func (c *RTRClient) hostSearchPage(ctx context.Context, path, filter, offset string, limit int) ([]string, string, int, error) {
+	reqURL := c.apiURL + path
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	// Build query parameters
+	q := req.URL.Query()
+	if filter != "" {
+		q.Set("filter", filter)
+	}
+	if offset != "" {
+		q.Set("offset", offset)
+	}
+	q.Set("limit", fmt.Sprintf("%d", limit))
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, "", 0, c.newAPIError("host search", resp)
+	}
+
+	var result struct {
+		Meta struct {
+			Pagination struct {
+				// Offset is a string token on the scroll endpoint and a number elsewhere
+				Offset json.RawMessage `json:"offset"`
+				Total  int             `json:"total"`
+			} `json:"pagination"`
+		} `json:"meta"`
+		Resources []string `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", 0, err
+	}
+
+	// A numeric or missing offset leaves the token empty
+	var token string
+	json.Unmarshal(result.Meta.Pagination.Offset, &token)
+
+	return result.Resources, token, result.Meta.Pagination.Total, nil
+}
+
+// HostInfo holds descriptive metadata for a host
+type HostInfo struct {
+	HostID       string `json:"device_id"`
+	Hostname     string `json:"hostname"`
+	PlatformName string `json:"platform_name"`
+	OSVersion    string `json:"os_version"`
+	LastSeen     string `json:"last_seen"`
+	// Fields holds the fields chosen with SetHostFields, keyed by API field name
+	Fields map[string]interface{} `json:"-"`
+}
+
+// HostDetailFields are the device fields that can be requested with SetHostFields
+var HostDetailFields = map[string]bool{
+	"agent_version":       true,
+	"cid":                 true,
+	"device_id":           true,
+	"external_ip":         true,
+	"first_seen":          true,
+	"hostname":            true,
+	"kernel_version":      true,
+	"last_seen":           true,
+	"local_ip":            true,
+	"mac_address":         true,
+	"machine_domain":      true,
+	"os_version":          true,
+	"ou":                  true,
+	"platform_name":       true,
+	"product_type_desc":   true,
+	"serial_number":       true,
+	"site_name":           true,
+	"status":              true,
+	"system_manufacturer": true,
+	"tags":                true,
+}
+
+// hostDetailsBatchSize is the maximum number of IDs the device entities endpoint accepts per call
+const hostDetailsBatchSize = 100
+
+// hostDetailsWorkers is the number of host detail requests sent concurrently
+const hostDetailsWorkers = 4
+
+// GetHostDetails looks up hostname, platform, OS version and last-seen time for agent IDs
+func (c *RTRClient) GetHostDetails(ids []string) (map[string]HostInfo, error) {
+	return c.GetHostDetailsContext(context.Background(), ids)
+}
+
+// GetHostDetailsContext is like GetHostDetails but honors ctx for cancellation and deadlines.
+// IDs are looked up in chunks, several at a time; when some chunks fail, the details that
+// were found are returned along with an error listing the failed chunks
+func (c *RTRClient) GetHostDetailsContext(ctx context.Context, ids []string) (map[string]HostInfo, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	chunks := ChunkHosts(ids, hostDetailsBatchSize)
+	details := make(map[string]HostInfo, len(ids))
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, hostDetailsWorkers)
+
+	// A failed chunk only loses the details of its own hosts
+	for i, chunk := range chunks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, chunk []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			hosts, err := c.hostDetailsPage(ctx, chunk)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("hosts %d-%d: %w", i*hostDetailsBatchSize+1, i*hostDetailsBatchSize+len(chunk), err))
+				return
+			}
+			for _, host := range hosts {
+				details[host.HostID] = host
+			}
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	return details, errors.Join(errs...)
+}
+
+// hostDetailsPage fetches metadata for at most hostDetailsBatchSize agent IDs
+func (c *RTRClient) hostDetailsPage(ctx context.Context, ids []string) ([]HostInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.apiURL+"/devices/entities/devices/v2", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	q := req.URL.Query()
+	for _, id := range ids {
+		q.Add("ids", id)
+	}
+	if len(c.hostFields) > 0 {
+		q.Set("fields", strings.Join(c.hostFields, ","))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("get host details", resp)
+	}
+
+	var result struct {
+		Resources []json.RawMessage `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	hosts := make([]HostInfo, 0, len(result.Resources))
+	for _, raw := range result.Resources {
+		var host HostInfo
+		if err := json.Unmarshal(raw, &host); err != nil {
+			return nil, err
+		}
+
+		// Keep only the requested fields, whatever else the API returned
+		if len(c.hostFields) > 0 {
+			var record map[string]interface{}
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return nil, err
+			}
+			host.Fields = make(map[string]interface{}, len(c.hostFields))
+			for _, field := range c.hostFields {
+				if value, ok := record[field]; ok {
+					host.Fields[field] = value
+				}
+			}
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// Range of timeouts accepted by the RTR batch endpoints
+const (
+	minBatchTimeout = 30 * time.Second
+	maxBatchTimeout = 600 * time.Second
+)
+
+// NormalizeTimeoutDuration converts a timeout_duration such as "10m", "10 m" or "600" (a bare
+// number is seconds) to the form the RTR API expects, whole minutes or seconds like "10m" or
+// "90s". An empty value stays empty so the API default applies
+func NormalizeTimeoutDuration(value string) (string, error) {
+	trimmed := strings.Join(strings.Fields(value), "")
+	if trimmed == "" {
+		return "", nil
+	}
+
+	if seconds, err := strconv.Atoi(trimmed); err == nil {
+		trimmed = strconv.Itoa(seconds) + "s"
+	}
+	d, err := time.ParseDuration(trimmed)
+	if err != nil {
+		return "", fmt.Errorf("invalid timeout_duration %q: expected a duration such as 30s or 10m, or a number of seconds", value)
+	}
+	if d%time.Second != 0 {
+		return "", fmt.Errorf("invalid timeout_duration %q: must be a whole number of seconds", value)
+	}
+
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", d/time.Minute), nil
+	}
+	return fmt.Sprintf("%ds", d/time.Second), nil
+}
+
+// validateBatchTimeouts checks the timeout (in seconds) and timeout_duration parameters are
+// within the range accepted by the RTR API and returns timeout_duration normalized; zero
+// values leave the API default in place
+func validateBatchTimeouts(timeoutSeconds int, timeoutDuration string) (string, error) {
+	if timeoutSeconds != 0 {
+		if err := CheckBatchTimeout("timeout", time.Duration(timeoutSeconds)*time.Second); err != nil {
+			return "", err
+		}
+	}
+
+	normalized, err := NormalizeTimeoutDuration(timeoutDuration)
+	if err != nil || normalized == "" {
+		return normalized, err
+	}
+	d, _ := time.ParseDuration(normalized)
+	if err := CheckBatchTimeout("timeout_duration", d); err != nil {
+		return "", err
+	}
+
+	return normalized, nil
+}
+
+// CheckBatchTimeout rejects a batch timeout outside the accepted range
+func CheckBatchTimeout(name string, d time.Duration) error {
+	if d < minBatchTimeout || d > maxBatchTimeout {
+		return fmt.Errorf("%s %s out of range: must be between %s and %s", name, d, minBatchTimeout, maxBatchTimeout)
+	}
+	return nil
+}
+
+// BatchInit initializes an RTR session across multiple hosts
+func (c *RTRClient) BatchInit(hostIDs []string, timeout, timeoutDuration string) (string, error) {
+	return c.BatchInitContext(context.Background(), hostIDs, timeout, timeoutDuration)
+}
+
+// BatchInitContext is like BatchInit but honors ctx for cancellation and deadlines
+func (c *RTRClient) BatchInitContext(ctx context.Context, hostIDs []string, timeout, timeoutDuration string) (string, error) {
+	result, err := c.BatchInitHostsContext(ctx, hostIDs, timeout, timeoutDuration)
+	if err != nil {
+		return "", err
+	}
+	return result.BatchID, nil
+}
+
+// BatchInitResult is the outcome of a batch init: the batch ID, the session opened on each
+// host that initialized, and the reason each remaining host failed
+type BatchInitResult struct {
+	BatchID  string
+	Sessions map[string]string
+	Failed   map[string]string
+}
+
+// Initialized returns the hosts from hostIDs that have a session in the batch, in order
+func (r *BatchInitResult) Initialized(hostIDs []string) []string {
+	var hosts []string
+	for _, host := range hostIDs {
+		if _, ok := r.Sessions[host]; ok {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// BatchInitHostsContext is like BatchInitContext but also reports which hosts initialized.
+// Hosts missing from the response, or returned without a session, are listed in Failed
+func (c *RTRClient) BatchInitHostsContext(ctx context.Context, hostIDs []string, timeout, timeoutDuration string) (*BatchInitResult, error) {
+	timeoutSeconds := 0
+	if timeout != "" {
+		var err error
+		if timeoutSeconds, err = strconv.Atoi(timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: must be a number of seconds", timeout)
+		}
+	}
+	timeoutDuration, err := validateBatchTimeouts(timeoutSeconds, timeoutDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	reqURL := c.baseURL + "/combined/batch-init-session/v1"
+
+	// Build query parameters
+	q := url.Values{}
+	if timeout != "" {
+		q.Set("timeout", timeout)
+	}
+	if timeoutDuration != "" {
+		q.Set("timeout_duration", timeoutDuration)
+	}
+	if len(q) > 0 {
+		reqURL += "?" + q.Encode()
+	}
+
+	payload := map[string]interface{}{
+		"host_ids": hostIDs,
+	}
+	// Queuing is decided when the session is created and applies to every command sent to it
+	if c.QueueOffline {
+		payload["queue_offline"] = true
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.doWithRetry(req, jsonData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return nil, c.newAPIError("batch init", resp)
+	}
+
+	var result struct {
+		BatchID   string `json:"batch_id"`
+		Resources map[string]struct {
+			SessionID string `json:"session_id"`
+			Stderr    string `json:"stderr"`
+			Errors    []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	initResult := &BatchInitResult{
+		BatchID:  result.BatchID,
+		Sessions: make(map[string]string),
+		Failed:   make(map[string]string),
+	}
+	for _, host := range hostIDs {
+		res, found := result.Resources[host]
+		switch {
+		case !found:
+			initResult.Failed[host] = "not included in the batch init response"
+		case res.SessionID != "":
+			initResult.Sessions[host] = res.SessionID
+		case len(res.Errors) > 0:
+			var msgs []string
+			for _, e := range res.Errors {
+				msgs = append(msgs, e.Message)
+			}
+			initResult.Failed[host] = strings.Join(msgs, "; ")
+		case res.Stderr != "":
+			initResult.Failed[host] = res.Stderr
+		default:
+			initResult.Failed[host] = "no session was opened"
+		}
+	}
+
+	// Track the per-host sessions so they can be closed if the run is interrupted
+	var sessionIDs []string
+	for _, res := range result.Resources {
+		if res.SessionID != "" {
+			sessionIDs = append(sessionIDs, res.SessionID)
+		}
+	}
+	c.trackBatch(result.BatchID, sessionIDs)
+
+	return initResult, nil
+}
+
+// trackBatch records the sessions opened for a batch
+func (c *RTRClient) trackBatch(batchID string, sessionIDs []string) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+
+	if c.activeSessions == nil {
+		c.activeSessions = make(map[string][]string)
+	}
+	c.activeSessions[batchID] = sessionIDs
+}
+
+// ReleaseBatch stops tracking a batch whose work finished normally
+func (c *RTRClient) ReleaseBatch(batchID string) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+
+	delete(c.activeSessions, batchID)
+}
+
+// CloseActiveSessions deletes the sessions of every batch that has not been released,
+// returning the first error encountered after attempting all of them
+func (c *RTRClient) CloseActiveSessions(ctx context.Context) error {
+	c.sessionsMu.Lock()
+	batches := c.activeSessions
+	c.activeSessions = nil
+	c.sessionsMu.Unlock()
+
+	var firstErr error
+	for batchID, sessionIDs := range batches {
+		for _, sessionID := range sessionIDs {
+			// A session that already expired needs no cleanup
+			if err := c.DeleteSessionContext(ctx, sessionID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+				c.Logger.Warn("could not close session", "batch_id", batchID, "session_id", sessionID, "error", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// ErrSessionNotFound is returned by DeleteSession when the session does not exist, typically
+// because it already expired or was deleted
+var ErrSessionNotFound = errors.New("session not found")
+
+// DeleteSession closes a single RTR session by ID
+func (c *RTRClient) DeleteSession(sessionID string) error {
+	return c.DeleteSessionContext(context.Background(), sessionID)
+}
+
+// DeleteSessionContext is like DeleteSession but honors ctx for cancellation and deadlines
+func (c *RTRClient) DeleteSessionContext(ctx context.Context, sessionID string) error {
+	if sessionID == "" {
+		return fmt.Errorf("session ID must not be empty")
+	}
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.baseURL+"/entities/sessions/v1", nil)
+	if err != nil {
+		return err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	q := req.URL.Query()
+	q.Set("session_id", sessionID)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	default:
+		return c.newAPIError("delete session", resp)
+	}
+}
+
+// BatchAdminCmd executes an RTR admin command across all hosts mapped to a batch ID
+func (c *RTRClient) BatchAdminCmd(batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	return c.BatchAdminCmdContext(context.Background(), batchID, command, commandString, timeout, timeoutDuration, optionalHosts)
+}
+
+// BatchAdminCmdContext is like BatchAdminCmd but honors ctx for cancellation and deadlines
+func (c *RTRClient) BatchAdminCmdContext(ctx context.Context, batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	return c.batchCommand(ctx, tierAdmin, batchID, command, commandString, timeout, timeoutDuration, optionalHosts)
+}
+
+// BatchCmd executes a read-only RTR command across all hosts mapped to a batch ID
+func (c *RTRClient) BatchCmd(batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	return c.BatchCmdContext(context.Background(), batchID, command, commandString, timeout, timeoutDuration, optionalHosts)
+}
+
+// BatchCmdContext is like BatchCmd but honors ctx for cancellation and deadlines
+func (c *RTRClient) BatchCmdContext(ctx context.Context, batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	return c.batchCommand(ctx, tierRead, batchID, command, commandString, timeout, timeoutDuration, optionalHosts)
+}
+
+// BatchActiveResponderCmd executes an RTR active-responder command across all hosts mapped to a batch ID
+func (c *RTRClient) BatchActiveResponderCmd(batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	return c.BatchActiveResponderCmdContext(context.Background(), batchID, command, commandString, timeout, timeoutDuration, optionalHosts)
+}
+
+// BatchActiveResponderCmdContext is like BatchActiveResponderCmd but honors ctx for cancellation and deadlines
+func (c *RTRClient) BatchActiveResponderCmdContext(ctx context.Context, batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	return c.batchCommand(ctx, tierActiveResponder, batchID, command, commandString, timeout, timeoutDuration, optionalHosts)
+}
+
+// BatchRunCmdContext executes an RTR command through the least privileged endpoint able to run it,
+// so API clients without admin scope can still run read-only commands
+func (c *RTRClient) BatchRunCmdContext(ctx context.Context, batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	tier, err := CommandTier(command, commandString)
+	if err != nil {
+		return nil, err
+	}
+	return c.batchCommand(ctx, tier, batchID, command, commandString, timeout, timeoutDuration, optionalHosts)
+}
+
+// batchCommandEndpoints maps command tiers to their batch command endpoint and operation name
+var batchCommandEndpoints = map[string]struct {
+	path string
+	op   string
+}{
+	tierRead:            {"/combined/batch-command/v1", "batch command"},
+	tierActiveResponder: {"/combined/batch-active-responder-command/v1", "batch active responder command"},
+	tierAdmin:           {"/combined/batch-admin-command/v1", "batch admin command"},
+}
+
+// batchCommand posts a command to the batch endpoint for the given tier
+func (c *RTRClient) batchCommand(ctx context.Context, tier, batchID, command, commandString string, timeout int, timeoutDuration string, optionalHosts []string) ([]byte, error) {
+	timeoutDuration, err := validateBatchTimeouts(timeout, timeoutDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	endpoint, ok := batchCommandEndpoints[tier]
+	if !ok {
+		return nil, fmt.Errorf("unknown command tier %q", tier)
+	}
+
+	reqURL := c.baseURL + endpoint.path
+
+	// Build query parameters
+	q := url.Values{}
+	if timeout > 0 {
+		q.Set("timeout", fmt.Sprintf("%d", timeout))
+	}
+	if timeoutDuration != "" {
+		q.Set("timeout_duration", timeoutDuration)
+	}
+	if len(q) > 0 {
+		reqURL += "?" + q.Encode()
+	}
+
+	payload := map[string]interface{}{
+		"base_command":   command,
+		"batch_id":       batchID,
+		"command_string": commandString,
+	}
+
+	if len(optionalHosts) > 0 {
+		payload["optional_hosts"] = optionalHosts
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	// Read-only commands are safe to send again; the others may already be running on the hosts
+	policy := retryUnsent
+	if tier == tierRead {
+		policy = retryFailures
+	}
+	resp, err := c.send(c.commandClient(commandWait(timeout, timeoutDuration)), req, jsonData, policy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, c.newAPIError(endpoint.op, resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// commandTimeoutSlack is the time a batch command call gets beyond the command timeout for the
+// API to collect and return the hosts' output
+const commandTimeoutSlack = 30 * time.Second
+
+// commandWait is how long the API may hold a batch command call open while hosts run the
+// command: the longer of the timeout and timeout_duration parameters, or the 30 second default
+func commandWait(timeoutSeconds int, timeoutDuration string) time.Duration {
+	wait := minBatchTimeout
+	if d := time.Duration(timeoutSeconds) * time.Second; d > wait {
+		wait = d
+	}
+	if d, err := time.ParseDuration(timeoutDuration); err == nil && d > wait {
+		wait = d
+	}
+	return wait
+}
+
+// commandClient returns the HTTP client for a call the API may hold open for wait. A shorter
+// per-request timeout would abandon the call while the command is still running on the hosts,
+// so it is raised to cover wait; the request context still bounds the call
+func (c *RTRClient) commandClient(wait time.Duration) *http.Client {
+	limit := wait + commandTimeoutSlack
+	if c.httpClient.Timeout == 0 || c.httpClient.Timeout >= limit {
+		return c.httpClient
+	}
+	client := *c.httpClient
+	client.Timeout = limit
+	return &client
+}
+
+// SessionRefreshInterval is the default RefreshInterval, comfortably inside the RTR session
+// idle timeout
+const SessionRefreshInterval = 5 * time.Minute
+
+// RefreshSession extends a batch session, optionally dropping hosts from it
+func (c *RTRClient) RefreshSession(batchID string, hostsToRemove []string) error {
+	return c.RefreshSessionContext(context.Background(), batchID, hostsToRemove)
+}
+
+// RefreshSessionContext is like RefreshSession but honors ctx for cancellation and deadlines
+func (c *RTRClient) RefreshSessionContext(ctx context.Context, batchID string, hostsToRemove []string) error {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return err
+	}
+
+	reqURL := c.baseURL + "/combined/batch-refresh-session/v1"
+
+	payload := map[string]interface{}{
+		"batch_id": batchID,
+	}
+
+	if len(hostsToRemove) > 0 {
+		payload["hosts_to_remove"] = hostsToRemove
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.doWithRetry(req, jsonData)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return c.newAPIError("batch refresh session", resp)
+	}
+
+	return nil
+}
+
+// WaitForBatchCommand polls a batch command until every host reports complete or the timeout
+// elapses, returning the final batch response
+func (c *RTRClient) WaitForBatchCommand(batchID, cloudRequestID string, pollInterval, timeout time.Duration) ([]byte, error) {
+	return c.WaitForBatchCommandContext(context.Background(), batchID, cloudRequestID, pollInterval, timeout)
+}
+
+// WaitForBatchCommandContext is like WaitForBatchCommand but honors ctx for cancellation
+func (c *RTRClient) WaitForBatchCommandContext(ctx context.Context, batchID, cloudRequestID string, pollInterval, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	lastRefresh := time.Now()
+	reported := make(map[string]bool)
+	for {
+		// Keep the batch session alive while waiting on long-running commands
+		if time.Since(lastRefresh) >= c.RefreshInterval {
+			if err := c.RefreshSessionContext(ctx, batchID, nil); err != nil {
+				c.Logger.Warn("could not refresh batch session", "batch_id", batchID, "error", err)
+			}
+			lastRefresh = time.Now()
+		}
+
+		body, err := c.batchCommandStatus(ctx, batchID, cloudRequestID)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("timed out waiting for batch command %s", cloudRequestID)
+			}
+			return nil, err
+		}
+
+		c.reportCompleted(body, reported)
+
+		if batchCommandComplete(body) {
+			return body, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return body, fmt.Errorf("timed out waiting for batch command %s", cloudRequestID)
+			}
+			return body, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// reportCompleted passes hosts that completed since the last poll to OnHostResult
+func (c *RTRClient) reportCompleted(body []byte, reported map[string]bool) {
+	if c.OnHostResult == nil {
+		return
+	}
+
+	results, err := ParseBatchResults(body)
+	if err != nil {
+		return
+	}
+	for host, result := range results {
+		if result.Complete && !reported[host] {
+			reported[host] = true
+			c.OnHostResult(result)
+		}
+	}
+}
+
+// batchCommandStatus fetches the current results of a batch command
+func (c *RTRClient) batchCommandStatus(ctx context.Context, batchID, cloudRequestID string) ([]byte, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	reqURL := c.baseURL + "/combined/batch-command/v1"
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	q := req.URL.Query()
+	q.Set("batch_id", batchID)
+	q.Set("cloud_request_id", cloudRequestID)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("batch command status", resp)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// BatchRequestID returns the cloud request ID of a host still running in a batch command
+// response, for polling with WaitForBatchCommand; it is "" when every host has completed
+func BatchRequestID(body []byte) string {
+	var result BatchCommandResponse
+	if err := json.Unmarshal(body, &result); err != nil || result.Combined == nil {
+		return ""
+	}
+
+	for _, res := range result.Combined.Resources {
+		if !res.Complete && res.TaskID != "" {
+			return res.TaskID
+		}
+	}
+	return ""
+}
+
+// batchCommandComplete reports whether every host in a batch response has completed
+func batchCommandComplete(body []byte) bool {
+	var result BatchCommandResponse
+	if err := json.Unmarshal(body, &result); err != nil || result.Combined == nil || len(result.Combined.Resources) == 0 {
+		return false
+	}
+
+	for _, res := range result.Combined.Resources {
+		if !res.Complete {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetRequest describes a per-host file retrieval started by BatchGetCmd
+type GetRequest struct {
+	HostID           string
+	SessionID        string
+	BatchGetCmdReqID string
+	SHA256           string
+	Name             string
+	Complete         bool
+	// Stderr is the error a host reported for the get command, such as a missing file
+	Stderr string
+}
+
+// BatchGetCmd issues the RTR get command for a file across all hosts mapped to a batch ID
+func (c *RTRClient) BatchGetCmd(batchID, filePath string, timeout int, timeoutDuration string, optionalHosts []string) (map[string]GetRequest, error) {
+	return c.BatchGetCmdContext(context.Background(), batchID, filePath, timeout, timeoutDuration, optionalHosts)
+}
+
+// BatchGetCmdContext is like BatchGetCmd but honors ctx for cancellation and deadlines
+func (c *RTRClient) BatchGetCmdContext(ctx context.Context, batchID, filePath string, timeout int, timeoutDuration string, optionalHosts []string) (map[string]GetRequest, error) {
+	timeoutDuration, err := validateBatchTimeouts(timeout, timeoutDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	reqURL := c.baseURL + "/combined/batch-get-command/v1"
+
+	// Build query parameters
+	q := url.Values{}
+	if timeout > 0 {
+		q.Set("timeout", fmt.Sprintf("%d", timeout))
+	}
+	if timeoutDuration != "" {
+		q.Set("timeout_duration", timeoutDuration)
+	}
+	if len(q) > 0 {
+		reqURL += "?" + q.Encode()
+	}
+
+	payload := map[string]interface{}{
+		"batch_id":  batchID,
+		"file_path": filePath,
+	}
+
+	if len(optionalHosts) > 0 {
+		payload["optional_hosts"] = optionalHosts
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.send(c.commandClient(commandWait(timeout, timeoutDuration)), req, jsonData, retryUnsent)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return nil, c.newAPIError("batch get command", resp)
+	}
+
+	var result struct {
+		BatchGetCmdReqID string `json:"batch_get_cmd_req_id"`
+		Combined         struct {
+			Resources map[string]struct {
+				SessionID string           `json:"session_id"`
+				Complete  bool             `json:"complete"`
+				Stderr    string           `json:"stderr"`
+				Errors    []APIErrorDetail `json:"errors"`
+			} `json:"resources"`
+		} `json:"combined"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	requests := make(map[string]GetRequest, len(result.Combined.Resources))
+	for hostID, res := range result.Combined.Resources {
+		stderr := res.Stderr
+		if stderr == "" && len(res.Errors) > 0 {
+			stderr = res.Errors[0].Message
+		}
+		requests[hostID] = GetRequest{
+			HostID:           hostID,
+			SessionID:        res.SessionID,
+			BatchGetCmdReqID: result.BatchGetCmdReqID,
+			Complete:         res.Complete,
+			Stderr:           stderr,
+		}
+	}
+
+	return requests, nil
+}
+
+// BatchGetCmdStatus retrieves the per-host file hashes for a batch get command once uploaded
+func (c *RTRClient) BatchGetCmdStatus(batchGetCmdReqID string) (map[string]GetRequest, error) {
+	return c.BatchGetCmdStatusContext(context.Background(), batchGetCmdReqID)
+}
+
+// BatchGetCmdStatusContext is like BatchGetCmdStatus but honors ctx for cancellation and deadlines
+func (c *RTRClient) BatchGetCmdStatusContext(ctx context.Context, batchGetCmdReqID string) (map[string]GetRequest, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	reqURL := c.baseURL + "/combined/batch-get-command/v1"
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	q := req.URL.Query()
+	q.Set("batch_get_cmd_req_id", batchGetCmdReqID)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("batch get command status", resp)
+	}
+
+	var result struct {
+		Resources map[string][]struct {
+			SessionID string `json:"session_id"`
+			SHA256    string `json:"sha256"`
+			Name      string `json:"name"`
+		} `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	requests := make(map[string]GetRequest, len(result.Resources))
+	for hostID, files := range result.Resources {
+		if len(files) == 0 {
+			continue
+		}
+		requests[hostID] = GetRequest{
+			HostID:           hostID,
+			SessionID:        files[0].SessionID,
+			BatchGetCmdReqID: batchGetCmdReqID,
+			SHA256:           files[0].SHA256,
+			Name:             files[0].Name,
+			Complete:         files[0].SHA256 != "",
+		}
+	}
+
+	return requests, nil
+}
+
+// GetExtractedFile downloads a retrieved file; the API returns it as a password-protected 7z archive
+func (c *RTRClient) GetExtractedFile(sha256, sessionID string) ([]byte, error) {
+	return c.GetExtractedFileContext(context.Background(), sha256, sessionID)
+}
+
+// GetExtractedFileContext is like GetExtractedFile but honors ctx for cancellation and deadlines
+func (c *RTRClient) GetExtractedFileContext(ctx context.Context, sha256, sessionID string) ([]byte, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	reqURL := c.baseURL + "/entities/extracted-file-contents/v1"
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "application/x-7z-compressed")
+
+	q := req.URL.Query()
+	q.Set("session_id", sessionID)
+	q.Set("sha256", sha256)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("get extracted file", resp)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// PutFile describes a file stored in the RTR cloud for use with the put command
+type PutFile struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	SHA256      string `json:"sha256"`
+	Size        int64  `json:"size"`
+	CreatedBy   string `json:"created_by"`
+}
+
+// UploadFile uploads a local file to the RTR put-files store and returns its ID
+func (c *RTRClient) UploadFile(name, description, filePath string) (string, error) {
+	return c.UploadFileContext(context.Background(), name, description, filePath)
+}
+
+// UploadFileContext is like UploadFile but honors ctx for cancellation and deadlines
+func (c *RTRClient) UploadFileContext(ctx context.Context, name, description, filePath string) (string, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return "", err
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = filepath.Base(filePath)
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.WriteField("name", name); err != nil {
+		return "", err
+	}
+	if err := writer.WriteField("description", description); err != nil {
+		return "", err
+	}
+	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(content); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	body := buf.Bytes()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/entities/put-files/v1", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	// Set headers, replacing the JSON content type with the multipart boundary
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.send(c.httpClient, req, body, retryUnsent)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", c.newAPIError("upload file", resp)
+	}
+
+	var result struct {
+		Resources []PutFile `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Resources) > 0 && result.Resources[0].ID != "" {
+		return result.Resources[0].ID, nil
+	}
+
+	// The create response does not always echo the new entity, so look it up by name
+	ids, err := c.queryPutFileIDs(ctx, "name:"+fqlString(name))
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("uploaded file %q not found in put-files store", name)
+	}
+
+	return ids[0], nil
+}
+
+// ListPutFiles returns all files in the RTR put-files store
+func (c *RTRClient) ListPutFiles() ([]PutFile, error) {
+	return c.ListPutFilesContext(context.Background())
+}
+
+// ListPutFilesContext is like ListPutFiles but honors ctx for cancellation and deadlines
+func (c *RTRClient) ListPutFilesContext(ctx context.Context) ([]PutFile, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	ids, err := c.queryPutFileIDs(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/entities/put-files/v2", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	q := req.URL.Query()
+	for _, id := range ids {
+		q.Add("ids", id)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("list put files", resp)
+	}
+
+	var result struct {
+		Resources []PutFile `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Resources, nil
+}
+
+// queryPutFileIDs returns the IDs of put-files matching an optional FQL filter
+func (c *RTRClient) queryPutFileIDs(ctx context.Context, filter string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/queries/put-files/v1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	if filter != "" {
+		q := req.URL.Query()
+		q.Set("filter", filter)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("query put files", resp)
+	}
+
+	var result struct {
+		Resources []string `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Resources, nil
+}
+
+// Script describes a custom script stored in the RTR cloud
+type Script struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Platform    []string `json:"platform"`
+}
+
+// ListScripts returns the custom scripts available in the RTR cloud
+func (c *RTRClient) ListScripts() ([]Script, error) {
+	return c.ListScriptsContext(context.Background())
+}
+
+// ListScriptsContext is like ListScripts but honors ctx for cancellation and deadlines
+func (c *RTRClient) ListScriptsContext(ctx context.Context) ([]Script, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/queries/scripts/v1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("query scripts", resp)
+	}
+
+	var ids struct {
+		Resources []string `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, err
+	}
+	if len(ids.Resources) == 0 {
+		return nil, nil
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "GET", c.baseURL+"/entities/scripts/v2", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	q := req.URL.Query()
+	for _, id := range ids.Resources {
+		q.Add("ids", id)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err = c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("get scripts", resp)
+	}
+
+	var result struct {
+		Resources []Script `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Resources, nil
+}
+
+// Session describes an RTR session
+type Session struct {
+	ID           string `json:"id"`
+	HostID       string `json:"device_id"`
+	Hostname     string `json:"hostname"`
+	PlatformName string `json:"platform_name"`
+	UserID       string `json:"user_id"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+	DeletedAt    string `json:"deleted_at"`
+	Offline      bool   `json:"offline_queued"`
+}
+
+// ListSessions returns the RTR sessions visible to the API client
+func (c *RTRClient) ListSessions() ([]Session, error) {
+	return c.ListSessionsContext(context.Background())
+}
+
+// ListSessionsContext is like ListSessions but honors ctx for cancellation and deadlines
+func (c *RTRClient) ListSessionsContext(ctx context.Context) ([]Session, error) {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/queries/sessions/v1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.doWithRetry(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("query sessions", resp)
+	}
+
+	var ids struct {
+		Resources []string `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, err
+	}
+	if len(ids.Resources) == 0 {
+		return nil, nil
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"ids": ids.Resources,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "POST", c.baseURL+"/entities/sessions/GET/v1", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	for k, v := range c.headerSnapshot() {
+		req.Header.Set(k, v)
+	}
+
+	resp, err = c.doWithRetry(req, jsonData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, c.newAPIError("get sessions", resp)
+	}
+
+	var result struct {
+		Resources []Session `json:"resources"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Resources, nil
+}
+
+// RTR command permission tiers, from least to most privileged
+const (
+	tierRead            = "read"
+	tierActiveResponder = "active-responder"
+	tierAdmin           = "admin"
+)
+
+// rtrCommandTiers maps RTR base commands to the tier required to run them
+var rtrCommandTiers = map[string]string{
+	"cat":          tierRead,
+	"cd":           tierRead,
+	"clear":        tierRead,
+	"env":          tierRead,
+	"eventlog":     tierRead,
+	"filehash":     tierRead,
+	"getsid":       tierRead,
+	"help":         tierRead,
+	"history":      tierRead,
+	"ipconfig":     tierRead,
+	"ls":           tierRead,
+	"mount":        tierRead,
+	"netstat":      tierRead,
+	"ps":           tierRead,
+	"reg":          tierRead,
+	"cp":           tierActiveResponder,
+	"encrypt":      tierActiveResponder,
+	"get":          tierActiveResponder,
+	"kill":         tierActiveResponder,
+	"map":          tierActiveResponder,
+	"memdump":      tierActiveResponder,
+	"mkdir":        tierActiveResponder,
+	"mv":           tierActiveResponder,
+	"restart":      tierActiveResponder,
+	"rm":           tierActiveResponder,
+	"shutdown":     tierActiveResponder,
+	"unmap":        tierActiveResponder,
+	"update":       tierActiveResponder,
+	"xmemdump":     tierActiveResponder,
+	"zip":          tierActiveResponder,
+	"falconscript": tierAdmin,
+	"put":          tierAdmin,
+	"put-and-run":  tierAdmin,
+	"run":          tierAdmin,
+	"runscript":    tierAdmin,
+}
+
+// CommandTier returns the tier required for a base command, taking reg subcommands into
+// account since only reg query is read-only
+func CommandTier(baseCommand, commandString string) (string, error) {
+	tier, ok := rtrCommandTiers[baseCommand]
+	if !ok {
+		return "", fmt.Errorf("unknown RTR command %q", baseCommand)
+	}
+
+	if baseCommand == "reg" {
+		fields := strings.Fields(commandString)
+		if len(fields) < 2 || fields[1] != "query" {
+			return tierActiveResponder, nil
+		}
+	}
+
+	return tier, nil
+}
+
+// tierScopes maps command tiers to the API scope their batch endpoint requires
+var tierScopes = map[string]string{
+	tierRead:            "real-time-response:read",
+	tierActiveResponder: "real-time-response:write",
+	tierAdmin:           "real-time-response-admin:write",
+}
+
+// RequiredScopes returns the API scopes needed to find hosts and run command on them,
+// or nil if the command is not a known RTR command
+func RequiredScopes(command string) []string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	tier, err := CommandTier(fields[0], command)
+	if err != nil {
+		return nil
+	}
+	return []string{"devices:read", tierScopes[tier]}
+}
+
+// MissingScopes returns the required scopes the current token was not granted. known is
+// false when the token response did not list its scopes, in which case nothing can be checked
+func (c *RTRClient) MissingScopes(required []string) (missing []string, known bool) {
+	c.headersMu.RLock()
+	defer c.headersMu.RUnlock()
+
+	if c.tokenScopes == nil {
+		return nil, false
+	}
+
+	granted := make(map[string]bool, len(c.tokenScopes))
+	for _, scope := range c.tokenScopes {
+		granted[scope] = true
+	}
+	for _, scope := range required {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing, true
+}
+
+// HostResult holds the outcome of running a command on a single host
+type HostResult struct {
+	HostID       string `json:"host_id"`
+	Hostname     string `json:"hostname,omitempty"`
+	Stdout       string `json:"stdout"`
+	Stderr       string `json:"stderr"`
+	Complete     bool   `json:"complete"`
+	Offline      bool   `json:"offline"`
+	ErrorMessage string `json:"error,omitempty"`
+}
+
+// ExitCode is derived from the result since RTR does not report a process exit status:
+// 0 on success, 1 when the command produced stderr or failed
+func (r HostResult) ExitCode() int {
+	if r.Failed() {
+		return 1
+	}
+	return 0
+}
+
+// MarshalJSON encodes the result with its derived exit_code
+func (r HostResult) MarshalJSON() ([]byte, error) {
+	type fields HostResult
+	return json.Marshal(struct {
+		fields
+		ExitCode int `json:"exit_code"`
+	}{fields(r), r.ExitCode()})
+}
+
+// Label identifies the host by hostname and agent ID when the hostname is known
+func (r HostResult) Label() string {
+	if r.Hostname == "" {
+		return r.HostID
+	}
+	return fmt.Sprintf("%s (%s)", r.Hostname, r.HostID)
+}
+
+// Failed reports whether the host produced an error or wrote to stderr
+func (r HostResult) Failed() bool {
+	return r.ErrorMessage != "" || r.Stderr != ""
+}
+
+// BatchCommandResponse is the body returned by the batch command endpoints and by polling.
+// Combined is nil when the response does not have the expected shape
+type BatchCommandResponse struct {
+	Combined *struct {
+		Resources map[string]BatchHostResponse `json:"resources"`
+	} `json:"combined,omitempty"`
+}
+
+// BatchHostResponse is a single host's entry in a batch command response
+type BatchHostResponse struct {
+	SessionID     string           `json:"session_id,omitempty"`
+	TaskID        string           `json:"task_id,omitempty"`
+	BaseCommand   string           `json:"base_command,omitempty"`
+	Complete      bool             `json:"complete"`
+	OfflineQueued bool             `json:"offline_queued,omitempty"`
+	Stdout        string           `json:"stdout,omitempty"`
+	Stderr        string           `json:"stderr,omitempty"`
+	Errors        []APIErrorDetail `json:"errors,omitempty"`
+}
+
+// ErrNoBatchResources is returned by ParseBatchResults when a response has no
+// combined.resources section, which usually means the response shape has changed
+var ErrNoBatchResources = errors.New("batch response has no combined.resources section")
+
+// ParseBatchResults extracts every host's result from a batch command response, keyed by host ID.
+// A response without host results returns an empty map and ErrNoBatchResources
+func ParseBatchResults(body []byte) (map[string]HostResult, error) {
+	results := make(map[string]HostResult)
+
+	// The response is already JSON; command output may legitimately contain quotes
+	var data BatchCommandResponse
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	if data.Combined == nil || data.Combined.Resources == nil {
+		return results, ErrNoBatchResources
+	}
+
+	for host, entry := range data.Combined.Resources {
+		result := HostResult{HostID: host, Complete: entry.Complete, Offline: entry.OfflineQueued}
+
+		// Output of a host that is still running is partial or empty, so only take it once complete
+		if result.Complete {
+			result.Stdout = entry.Stdout
+			result.Stderr = entry.Stderr
+		}
+
+		if len(entry.Errors) > 0 {
+			result.ErrorMessage = entry.Errors[0].Message
+		}
+
+		results[host] = result
+	}
+
+	return results, nil
+}
+
+// ChunkHosts splits hosts into batches of at most size hosts each
+func ChunkHosts(hosts []string, size int) [][]string {
+	var batches [][]string
+	for start := 0; start < len(hosts); start += size {
+		end := start + size
+		if end > len(hosts) {
+			end = len(hosts)
+		}
+		batches = append(batches, hosts[start:end])
+	}
+	return batches
+}
@@ -0,0 +1,2258 @@
+package rtr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI stands in for the CrowdStrike API. It answers token requests itself and routes
+// every other request to the handler registered for "METHOD path"
+type fakeAPI struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	handlers  map[string]http.HandlerFunc
+	requests  []recordedRequest
+	expiresIn int
+}
+
+// recordedRequest is a request received by fakeAPI
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	return &fakeAPI{t: t, handlers: make(map[string]http.HandlerFunc), expiresIn: 1800}
+}
+
+// handle registers h for a route such as "POST /real-time-response/combined/batch-command/v1"
+func (f *fakeAPI) handle(route string, h http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handlers[route] = h
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	f.mu.Lock()
+	f.requests = append(f.requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone(), Body: body})
+	h := f.handlers[r.Method+" "+r.URL.Path]
+	expiresIn := f.expiresIn
+	f.mu.Unlock()
+
+	switch {
+	case h != nil:
+		h(w, r)
+	case r.URL.Path == "/oauth2/token":
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"access_token": "test-token", "token_type": "bearer", "expires_in": expiresIn})
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// recorded returns the requests received for a route
+func (f *fakeAPI) recorded(route string) []recordedRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var requests []recordedRequest
+	for _, req := range f.requests {
+		if req.Method+" "+req.Path == route {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// count returns the number of requests received for a route
+func (f *fakeAPI) count(route string) int {
+	return len(f.recorded(route))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// newTestClient starts a server for api and returns a client for it that retries without
+// delay and discards its logs
+func newTestClient(t *testing.T, api http.Handler) *RTRClient {
+	t.Helper()
+
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return newClientFor(t, srv.URL)
+}
+
+// newClientFor returns a client for the API at baseURL that retries without delay and
+// discards its logs
+func newClientFor(t *testing.T, baseURL string) *RTRClient {
+	t.Helper()
+
+	c, err := NewRTRClientWithOptions("test-id", "test-secret", WithBaseURL(baseURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryDelay = time.Millisecond
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return c
+}
+
+func TestNewRTRClientCertificateVerification(t *testing.T) {
+	srv := httptest.NewUnstartedServer(newFakeAPI(t))
+	// The rejected handshake is expected; keep the server from logging it
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	verifying := NewRTRClient("test-id", "test-secret", srv.URL, true)
+	verifying.MaxRetries = 0
+	var unknownAuthority x509.UnknownAuthorityError
+	if err := verifying.Authenticate(); !errors.As(err, &unknownAuthority) {
+		t.Fatalf("Authenticate with verification = %v, want an unknown authority error", err)
+	}
+
+	insecure := NewRTRClient("test-id", "test-secret", srv.URL, false)
+	insecure.MaxRetries = 0
+	if err := insecure.Authenticate(); err != nil {
+		t.Fatalf("Authenticate without verification: %v", err)
+	}
+}
+
+// writeClientCertificate writes a new self-signed client certificate and its key as PEM files
+// and returns their paths with the parsed certificate
+func writeClientCertificate(t *testing.T) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rtr-test-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestClientCertificate(t *testing.T) {
+	certFile, keyFile, cert := writeClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(newFakeAPI(t))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	// The handshake without a certificate is expected to fail; keep the server from logging it
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(opts ...Option) *RTRClient {
+		t.Helper()
+
+		c, err := NewRTRClientWithOptions("test-id", "test-secret", append([]Option{WithBaseURL(srv.URL), WithInsecureSkipVerify()}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.MaxRetries = 0
+		c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		return c
+	}
+
+	if err := newClient().Authenticate(); err == nil {
+		t.Error("Authenticate without a client certificate succeeded")
+	}
+	if err := newClient(WithClientCertificate(certFile, keyFile)).Authenticate(); err != nil {
+		t.Errorf("Authenticate with a client certificate: %v", err)
+	}
+
+	if _, err := NewRTRClientWithOptions("id", "secret", WithClientCertificate(keyFile, certFile)); err == nil {
+		t.Error("WithClientCertificate accepted swapped files")
+	}
+	if _, err := NewRTRClientWithOptions("id", "secret", WithHTTPClient(&http.Client{Transport: &recordingTransport{}}), WithClientCertificate(certFile, keyFile)); err == nil {
+		t.Error("WithClientCertificate accepted a custom transport")
+	}
+}
+
+// emptySearch answers a host query with no matches
+func emptySearch(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []string{}})
+}
+
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		expiresIn  int
+		wantTokens int
+	}{
+		{expiresIn: 1800, wantTokens: 1},
+		// Inside the refresh window, so every call fetches a new token
+		{expiresIn: 30, wantTokens: 2},
+	} {
+		api := newFakeAPI(t)
+		api.expiresIn = tc.expiresIn
+		api.handle("GET "+devicesQueryPath, emptySearch)
+		c := newTestClient(t, api)
+
+		for i := 0; i < 2; i++ {
+			if _, err := c.HostSearch("", "", "", 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := api.count("POST /oauth2/token"); got != tc.wantTokens {
+			t.Errorf("expires_in %d: %d token requests, want %d", tc.expiresIn, got, tc.wantTokens)
+		}
+	}
+}
+
+// statusSequence answers with the given statuses in turn, then with ok for every later request
+func statusSequence(statuses []int, ok http.HandlerFunc) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		var status int
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+
+		if status == 0 {
+			ok(w, r)
+			return
+		}
+		if status == http.StatusServiceUnavailable && r.Header.Get("X-Test-Body") == "" {
+			w.WriteHeader(status)
+			return
+		}
+		writeJSON(w, status, map[string]interface{}{"errors": []APIErrorDetail{{Code: status, Message: "failed"}}})
+	}
+}
+
+// completeBatch answers a batch command with every host complete
+func completeBatch(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"combined": map[string]interface{}{"resources": map[string]interface{}{
+			"host-1": map[string]interface{}{"complete": true, "stdout": "done"},
+		}},
+	})
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, statusSequence([]int{503, 503}, emptySearch))
+	c := newTestClient(t, api)
+	c.MaxRetries = 3
+
+	if _, err := c.HostSearch("", "", "", 0); err != nil {
+		t.Fatalf("HostSearch after two 503s: %v", err)
+	}
+	if got := api.count("GET " + devicesQueryPath); got != 3 {
+		t.Errorf("%d host search attempts, want 3", got)
+	}
+}
+
+func TestRetryStateChangingCommands(t *testing.T) {
+	const adminPath = "/real-time-response/combined/batch-admin-command/v1"
+	const readPath = "/real-time-response/combined/batch-command/v1"
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		statuses []int
+		// body makes 503 responses carry an error body
+		body         bool
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "admin 500 may have run", path: adminPath, statuses: []int{500}, wantAttempts: 1, wantErr: true},
+		{name: "admin 503 with body may have run", path: adminPath, statuses: []int{503}, body: true, wantAttempts: 1, wantErr: true},
+		{name: "admin empty 503 never ran", path: adminPath, statuses: []int{503}, wantAttempts: 2},
+		{name: "admin 429 never ran", path: adminPath, statuses: []int{429}, wantAttempts: 2},
+		{name: "read 500 is safe to repeat", path: readPath, statuses: []int{500}, wantAttempts: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newFakeAPI(t)
+			api.handle("POST "+tc.path, statusSequence(tc.statuses, completeBatch))
+			c := newTestClient(t, api)
+			c.MaxRetries = 3
+			if tc.body {
+				c.setHeader("X-Test-Body", "1")
+			}
+
+			command := "runscript"
+			if tc.path == readPath {
+				command = "ls"
+			}
+			_, err := c.BatchRunCmdContext(context.Background(), "batch-1", command, command+" x", 30, "", nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tc.wantErr)
+			}
+			if got := api.count("POST " + tc.path); got != tc.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryUnsentAfterRefusedConnection(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := srv.URL
+	srv.Close()
+
+	c := newTestClient(t, newFakeAPI(t))
+	c.MaxRetries = 2
+	req, err := http.NewRequest("POST", addr+"/real-time-response/combined/batch-admin-command/v1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each refused attempt is counted as an error with no response
+	c.send(c.httpClient, req, []byte("{}"), retryUnsent)
+	stats := c.Stats()
+	if len(stats.Endpoints) != 1 || stats.Endpoints[0].Errors != 3 {
+		t.Errorf("stats = %+v, want 3 failed attempts", stats.Endpoints)
+	}
+}
+
+// timeoutError is a net.Error reporting a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// lostResponseTransport delivers each request and then fails it with a timeout, as when the
+// response is lost after the API has carried out the request
+type lostResponseTransport struct{}
+
+func (lostResponseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return nil, timeoutError{}
+}
+
+func TestRetryStateChangingCommandAfterTimeout(t *testing.T) {
+	const adminPath = "/real-time-response/combined/batch-admin-command/v1"
+	api := newFakeAPI(t)
+	api.handle("POST "+adminPath, completeBatch)
+	c := newTestClient(t, api)
+	c.MaxRetries = 3
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetHTTPClient(&http.Client{Transport: lostResponseTransport{}})
+
+	if _, err := c.BatchAdminCmd("batch-1", "runscript", "runscript -Raw=```id```", 30, "", nil); err == nil {
+		t.Fatal("BatchAdminCmd succeeded, want the timeout error")
+	}
+	if got := api.count("POST " + adminPath); got != 1 {
+		t.Errorf("command sent %d times after a timeout, want 1", got)
+	}
+}
+
+func TestRetryAfterHonored(t *testing.T) {
+	api := newFakeAPI(t)
+	limited := false
+	api.handle("GET "+devicesQueryPath, func(w http.ResponseWriter, r *http.Request) {
+		if !limited {
+			limited = true
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		emptySearch(w, r)
+	})
+	c := newTestClient(t, api)
+	c.MaxRetries = 1
+
+	start := time.Now()
+	if _, err := c.HostSearch("", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least the 1s Retry-After", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("7"); !ok || d != 7*time.Second {
+		t.Errorf("parseRetryAfter(7) = %s, %v", d, ok)
+	}
+
+	date := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(date); !ok || d < 28*time.Second || d > 30*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %s, %v, want about 30s", date, d, ok)
+	}
+
+	past := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(past); !ok || d != 0 {
+		t.Errorf("parseRetryAfter(past date) = %s, %v, want 0", d, ok)
+	}
+
+	for _, value := range []string{"", "-1", "soon"} {
+		if _, ok := parseRetryAfter(value); ok {
+			t.Errorf("parseRetryAfter(%q) accepted", value)
+		}
+	}
+}
+
+func TestRegionBaseURL(t *testing.T) {
+	for region, want := range map[string]string{
+		"":         "https://api.crowdstrike.com",
+		"us-1":     "https://api.crowdstrike.com",
+		"US-2":     "https://api.us-2.crowdstrike.com",
+		"eu-1":     "https://api.eu-1.crowdstrike.com",
+		"us-gov-1": "https://api.laggar.gcw.crowdstrike.com",
+	} {
+		got, err := RegionBaseURL(region)
+		if err != nil || got != want {
+			t.Errorf("RegionBaseURL(%q) = %q, %v, want %q", region, got, err, want)
+		}
+	}
+
+	if _, err := RegionBaseURL("ap-1"); err == nil {
+		t.Error("RegionBaseURL accepted an unknown region")
+	}
+	if _, err := NewRTRClientWithOptions("id", "secret", WithRegion("ap-1")); err == nil {
+		t.Error("WithRegion accepted an unknown region")
+	}
+}
+
+func TestParseBatchResultsStderr(t *testing.T) {
+	body := []byte(`{"combined":{"resources":{
+		"ok":{"complete":true,"stdout":"fine"},
+		"stderr":{"complete":true,"stdout":"partial","stderr":"access denied"},
+		"error":{"complete":true,"errors":[{"code":40401,"message":"command failed"}]}
+	}}}`)
+
+	results, err := ParseBatchResults(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results["ok"]; r.Stdout != "fine" || r.Failed() {
+		t.Errorf("ok = %+v", r)
+	}
+	if r := results["stderr"]; r.Stdout != "partial" || r.Stderr != "access denied" || !r.Failed() {
+		t.Errorf("stderr = %+v", r)
+	}
+	if r := results["error"]; r.ErrorMessage != "command failed" || !r.Failed() {
+		t.Errorf("error = %+v", r)
+	}
+
+	// The exit code follows the result wherever it came from
+	for host, want := range map[string]int{"ok": 0, "stderr": 1, "error": 1} {
+		if got := results[host].ExitCode(); got != want {
+			t.Errorf("%s exit code = %d, want %d", host, got, want)
+		}
+	}
+	data, err := json.Marshal(results["stderr"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"exit_code":1`) || !strings.Contains(string(data), `"stderr":"access denied"`) {
+		t.Errorf("encoded result = %s", data)
+	}
+}
+
+func TestParseBatchResultsShape(t *testing.T) {
+	// Fields the client does not know about are ignored
+	body := []byte(`{"meta":{"query_time":0.5},"combined":{"resources":{
+		"aaa":{"session_id":"s1","task_id":"t1","complete":true,"stdout":"fine","new_field":{"nested":true}},
+		"bbb":{"complete":false,"offline_queued":true}
+	}},"errors":[]}`)
+	results, err := ParseBatchResults(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results = %+v, want one per host", results)
+	}
+	if r := results["aaa"]; r.HostID != "aaa" || !r.Complete || r.Stdout != "fine" {
+		t.Errorf("aaa = %+v", r)
+	}
+	if r := results["bbb"]; !r.Offline || r.Complete {
+		t.Errorf("bbb = %+v", r)
+	}
+
+	for _, body := range []string{`{"resources":{"aaa":{"complete":true}}}`, `{"combined":{}}`, `{}`} {
+		results, err := ParseBatchResults([]byte(body))
+		if !errors.Is(err, ErrNoBatchResources) {
+			t.Errorf("%s: err = %v, want ErrNoBatchResources", body, err)
+		}
+		if results == nil || len(results) != 0 {
+			t.Errorf("%s: results = %v, want an empty map", body, results)
+		}
+	}
+
+	// A response with no host entries is still the expected shape
+	if results, err := ParseBatchResults([]byte(`{"combined":{"resources":{}}}`)); err != nil || len(results) != 0 {
+		t.Errorf("empty resources = %v, %v", results, err)
+	}
+	if _, err := ParseBatchResults([]byte(`not json`)); err == nil || errors.Is(err, ErrNoBatchResources) {
+		t.Errorf("invalid JSON err = %v", err)
+	}
+}
+
+func TestAPIErrorTyped(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{
+			"errors": []APIErrorDetail{{Code: 403, Message: "access denied, authorization failed"}},
+		})
+	})
+	c := newTestClient(t, api)
+
+	_, err := c.HostSearch("", "", "", 0)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("HostSearch error %v is not an *APIError", err)
+	}
+	if apiErr.Op != "host search" || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("APIError = %+v", apiErr)
+	}
+	if len(apiErr.Errors) != 1 || apiErr.Errors[0].Message != "access denied, authorization failed" {
+		t.Errorf("Errors = %+v", apiErr.Errors)
+	}
+}
+
+// pagedSearch serves ids from the scroll host query endpoint, at most pageSize per request,
+// returning a token for the next page
+func pagedSearch(ids []string, pageSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset := 0
+		if token := r.URL.Query().Get("offset"); token != "" {
+			after, ok := strings.CutPrefix(token, "after-")
+			n, err := strconv.Atoi(after)
+			if !ok || err != nil || n > len(ids) {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []map[string]interface{}{{"message": "invalid offset token"}}})
+				return
+			}
+			offset = n
+		}
+		end := searchPageEnd(r, offset, len(ids), pageSize)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"meta":      map[string]interface{}{"pagination": map[string]interface{}{"total": len(ids), "offset": "after-" + strconv.Itoa(end)}},
+			"resources": append([]string{}, ids[offset:end]...),
+		})
+	}
+}
+
+// offsetSearch serves ids from a host query endpoint paged by numeric offset, at most
+// pageSize per request
+func offsetSearch(ids []string, pageSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		if offset > len(ids) {
+			offset = len(ids)
+		}
+		end := searchPageEnd(r, offset, len(ids), pageSize)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"meta":      map[string]interface{}{"pagination": map[string]interface{}{"total": len(ids), "offset": offset}},
+			"resources": append([]string{}, ids[offset:end]...),
+		})
+	}
+}
+
+// searchPageEnd returns the end of the page starting at offset, honoring the request limit
+func searchPageEnd(r *http.Request, offset, total, pageSize int) int {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit > pageSize {
+		limit = pageSize
+	}
+	if offset+limit > total {
+		return total
+	}
+	return offset + limit
+}
+
+func TestIncludeHidden(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, pagedSearch([]string{"a", "b"}, 5))
+	api.handle("GET "+hiddenDevicesQueryPath, offsetSearch([]string{"b", "c"}, 5))
+	c := newTestClient(t, api)
+
+	hosts, err := c.HostSearch("web-*", "hostname", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(hosts, ",") != "a,b" || api.count("GET "+hiddenDevicesQueryPath) != 0 {
+		t.Errorf("without IncludeHidden = %v, %d hidden queries", hosts, api.count("GET "+hiddenDevicesQueryPath))
+	}
+
+	c.IncludeHidden = true
+	hosts, err = c.HostSearch("web-*", "hostname", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(hosts, ",") != "a,b,c" {
+		t.Errorf("with IncludeHidden = %v, want the hidden host once after the visible ones", hosts)
+	}
+	hidden := api.recorded("GET " + hiddenDevicesQueryPath)
+	if len(hidden) != 1 || hidden[0].Query.Get("filter") != "hostname:'web-*'" {
+		t.Errorf("hidden queries = %+v, want the same filter", hidden)
+	}
+
+	// A limit already met by visible hosts skips the hidden query
+	if hosts, err := c.HostSearch("", "", "", 2); err != nil || len(hosts) != 2 || api.count("GET "+hiddenDevicesQueryPath) != 1 {
+		t.Errorf("limit 2 = %v, %v, %d hidden queries", hosts, err, api.count("GET "+hiddenDevicesQueryPath))
+	}
+
+	// The hidden query returns no token, so its pages follow by offset
+	api = newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, pagedSearch([]string{"a"}, 5))
+	api.handle("GET "+hiddenDevicesQueryPath, offsetSearch([]string{"h1", "h2", "h3"}, 2))
+	c = newTestClient(t, api)
+	c.IncludeHidden = true
+	if hosts, err := c.HostSearch("", "", "", 0); err != nil || strings.Join(hosts, ",") != "a,h1,h2,h3" {
+		t.Errorf("paged hidden search = %v, %v", hosts, err)
+	}
+	if hidden := api.recorded("GET " + hiddenDevicesQueryPath); len(hidden) != 2 || hidden[1].Query.Get("offset") != "2" {
+		t.Errorf("hidden queries = %+v, want a second page at offset 2", hidden)
+	}
+}
+
+// gzipSearch answers a host query with a gzip-encoded body listing ids
+func gzipSearch(ids []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			http.Error(w, "gzip not accepted", http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		zw := gzip.NewWriter(w)
+		json.NewEncoder(zw).Encode(map[string]interface{}{
+			"meta":      map[string]interface{}{"pagination": map[string]interface{}{"total": len(ids)}},
+			"resources": ids,
+		})
+		zw.Close()
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, gzipSearch(ids))
+
+	tlsSrv := httptest.NewTLSServer(api)
+	defer tlsSrv.Close()
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	// The default transport, the insecure one and one with compression turned off all decode it
+	insecure, err := NewRTRClientWithOptions("test-id", "test-secret", WithBaseURL(tlsSrv.URL), WithInsecureSkipVerify())
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := NewRTRClientWithOptions("test-id", "test-secret", WithBaseURL(srv.URL),
+		WithHTTPClient(&http.Client{Transport: &http.Transport{DisableCompression: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]*RTRClient{"default": newClientFor(t, srv.URL), "insecure": insecure, "no compression": custom} {
+		c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		hosts, err := c.HostSearch("", "", "", 0)
+		if err != nil || strings.Join(hosts, ",") != "a,b,c" {
+			t.Errorf("%s transport = %v, %v", name, hosts, err)
+		}
+	}
+
+	// A body that claims to be gzip but is not fails cleanly
+	api.handle("GET "+devicesQueryPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		io.WriteString(w, `{"resources":[]}`)
+	})
+	c := newClientFor(t, srv.URL)
+	c.MaxRetries = 0
+	if _, err := c.HostSearch("", "", "", 0); err == nil || !strings.Contains(err.Error(), "decompressing response") {
+		t.Errorf("corrupt gzip body = %v", err)
+	}
+}
+
+func TestHostSearchPagination(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e", "f", "g"}
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, pagedSearch(ids, 5))
+	c := newTestClient(t, api)
+
+	hosts, err := c.HostSearch("", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(hosts, "") != "abcdefg" {
+		t.Errorf("hosts = %v, want all seven", hosts)
+	}
+	// Later pages are requested with the token the previous page returned
+	requests := api.recorded("GET " + devicesQueryPath)
+	if len(requests) != 2 || requests[0].Query.Has("offset") || requests[1].Query.Get("offset") != "after-5" {
+		t.Fatalf("requests = %+v, want two pages with the second after the first page's token", requests)
+	}
+
+	// A limit caps the total and shrinks the last page
+	hosts, err = c.HostSearch("", "", "", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests = api.recorded("GET " + devicesQueryPath)
+	if len(hosts) != 6 || requests[len(requests)-1].Query.Get("limit") != "1" {
+		t.Errorf("limited search returned %v, last request %v", hosts, requests[len(requests)-1].Query)
+	}
+}
+
+const batchGetPath = "/real-time-response/combined/batch-get-command/v1"
+
+func TestBatchGetFile(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("POST "+batchGetPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"batch_get_cmd_req_id": "req-1",
+			"combined": map[string]interface{}{"resources": map[string]interface{}{
+				"host-1": map[string]interface{}{"session_id": "s1", "complete": true},
+				"host-2": map[string]interface{}{"session_id": "s2", "complete": true, "stderr": "file not found"},
+			}},
+		})
+	})
+	api.handle("GET "+batchGetPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": map[string]interface{}{
+			"host-1": []map[string]interface{}{{"session_id": "s1", "sha256": "abc123", "name": `C:\secret.txt`}},
+		}})
+	})
+	api.handle("GET /real-time-response/entities/extracted-file-contents/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-7z-compressed")
+		w.Write([]byte("7z-archive"))
+	})
+	c := newTestClient(t, api)
+
+	requests, err := c.BatchGetCmd("batch-1", `C:\secret.txt`, 30, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := requests["host-1"]; r.BatchGetCmdReqID != "req-1" || r.SessionID != "s1" {
+		t.Errorf("host-1 = %+v", r)
+	}
+	if r := requests["host-2"]; r.Stderr != "file not found" {
+		t.Errorf("host-2 = %+v", r)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal(api.recorded("POST " + batchGetPath)[0].Body, &payload)
+	if payload["batch_id"] != "batch-1" || payload["file_path"] != `C:\secret.txt` {
+		t.Errorf("payload = %v", payload)
+	}
+
+	status, err := c.BatchGetCmdStatus("req-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := status["host-1"]
+	if !upload.Complete || upload.SHA256 != "abc123" {
+		t.Fatalf("status = %+v", status)
+	}
+
+	content, err := c.GetExtractedFile(upload.SHA256, upload.SessionID)
+	if err != nil || string(content) != "7z-archive" {
+		t.Fatalf("GetExtractedFile = %q, %v", content, err)
+	}
+	query := api.recorded("GET /real-time-response/entities/extracted-file-contents/v1")[0].Query
+	if query.Get("sha256") != "abc123" || query.Get("session_id") != "s1" {
+		t.Errorf("download query = %v", query)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collect.ps1")
+	if err := os.WriteFile(path, []byte("Get-Process"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api := newFakeAPI(t)
+	var name, description, filename, content string
+	api.handle("POST /real-time-response/entities/put-files/v1", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parsing upload: %v", err)
+		}
+		name, description = r.FormValue("name"), r.FormValue("description")
+		file, header, err := r.FormFile("file")
+		if err == nil {
+			data, _ := io.ReadAll(file)
+			filename, content = header.Filename, string(data)
+		}
+		// The create response does not echo the entity, so the ID is looked up by name
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []interface{}{}})
+	})
+	api.handle("GET /real-time-response/queries/put-files/v1", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("filter"); got != "name:'tools.ps1'" {
+			t.Errorf("lookup filter = %q", got)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []string{"put-1"}})
+	})
+	c := newTestClient(t, api)
+
+	id, err := c.UploadFile("tools.ps1", "collection script", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "put-1" {
+		t.Errorf("id = %q, want put-1", id)
+	}
+	if name != "tools.ps1" || description != "collection script" || filename != "collect.ps1" || content != "Get-Process" {
+		t.Errorf("upload = name %q, description %q, file %q with %q", name, description, filename, content)
+	}
+
+	// A quote in the name is escaped rather than ending the FQL string
+	api.handle("GET /real-time-response/queries/put-files/v1", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("filter"); got != `name:'it\'s.ps1'` {
+			t.Errorf("lookup filter = %q", got)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []string{"put-2"}})
+	})
+	if id, err := c.UploadFile("it's.ps1", "", path); err != nil || id != "put-2" {
+		t.Errorf("upload with a quote = %q, %v", id, err)
+	}
+
+	// A cancelled context stops the upload and the listing before anything is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.UploadFileContext(ctx, "tools.ps1", "", path); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled UploadFileContext = %v", err)
+	}
+	if _, err := c.ListPutFilesContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled ListPutFilesContext = %v", err)
+	}
+	if got := api.count("POST /real-time-response/entities/put-files/v1"); got != 2 {
+		t.Errorf("%d uploads, want only the 2 before cancelling", got)
+	}
+	if got := api.count("GET /real-time-response/queries/put-files/v1"); got != 2 {
+		t.Errorf("%d put-file queries, want only the 2 before cancelling", got)
+	}
+}
+
+// stall holds a request open until the client gives up or a second passes
+func stall(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-r.Context().Done():
+	case <-time.After(time.Second):
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, stall)
+	c := newTestClient(t, api)
+	c.MaxRetries = 0
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(50 * time.Millisecond)
+
+	_, err := c.HostSearch("", "", "", 0)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("HostSearch = %v, want a timeout", err)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, stall)
+	c := newTestClient(t, api)
+	c.MaxRetries = 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := c.HostSearchContext(ctx, "", "", "", 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("HostSearchContext = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("returned %s after cancellation", elapsed)
+	}
+	if got := api.count("GET " + devicesQueryPath); got != 1 {
+		t.Errorf("%d attempts, want no retry after cancellation", got)
+	}
+}
+
+const batchCommandPath = "/real-time-response/combined/batch-command/v1"
+
+// batchBody builds a batch command response from per-host entries
+func batchBody(hosts map[string]BatchHostResponse) map[string]interface{} {
+	return map[string]interface{}{"combined": map[string]interface{}{"resources": hosts}}
+}
+
+// pollSequence answers batch command polls with the given responses in turn, repeating the last
+func pollSequence(responses ...map[string]BatchHostResponse) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts := responses[0]
+		if len(responses) > 1 {
+			responses = responses[1:]
+		}
+		mu.Unlock()
+		writeJSON(w, http.StatusOK, batchBody(hosts))
+	}
+}
+
+func TestWaitForBatchCommand(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+batchCommandPath, pollSequence(
+		map[string]BatchHostResponse{"host-1": {TaskID: "task-1"}},
+		map[string]BatchHostResponse{"host-1": {TaskID: "task-1", Complete: true, Stdout: "done"}},
+	))
+	c := newTestClient(t, api)
+
+	body, err := c.WaitForBatchCommand("batch-1", "task-1", time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := ParseBatchResults(body)
+	if r := results["host-1"]; !r.Complete || r.Stdout != "done" {
+		t.Errorf("result = %+v", r)
+	}
+	polls := api.recorded("GET " + batchCommandPath)
+	if len(polls) != 2 {
+		t.Fatalf("%d polls, want 2", len(polls))
+	}
+	if q := polls[0].Query; q.Get("batch_id") != "batch-1" || q.Get("cloud_request_id") != "task-1" {
+		t.Errorf("poll query = %v", q)
+	}
+}
+
+func TestWaitForBatchCommandTimeout(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+batchCommandPath, pollSequence(map[string]BatchHostResponse{"host-1": {TaskID: "task-1"}}))
+	c := newTestClient(t, api)
+
+	_, err := c.WaitForBatchCommand("batch-1", "task-1", time.Millisecond, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out waiting for batch command task-1") {
+		t.Fatalf("error = %v, want a timeout", err)
+	}
+}
+
+func TestDebugLogging(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, emptySearch)
+	c := newTestClient(t, api)
+	var logs bytes.Buffer
+	c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	if _, err := c.HostSearch("", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`msg="http request" method=GET url="http://`,
+		devicesQueryPath + "?limit=5000",
+		`msg="http response" method=GET`,
+		"status=200",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("debug log is missing %q:\n%s", want, logs.String())
+		}
+	}
+
+	// Nothing is logged above the debug level
+	logs.Reset()
+	c.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	if _, err := c.HostSearch("", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("info level logged requests:\n%s", logs.String())
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"client_id=abc&client_secret=s3cr3t&x=1", "client_id=abc&client_secret=[REDACTED]&x=1"},
+		{`{"client_secret": "s3cr3t"}`, `{"client_secret": "[REDACTED]"}`},
+		{`{"access_token":"eyJ.abc.def","expires_in":1799}`, `{"access_token":"[REDACTED]","expires_in":1799}`},
+		{"Authorization: Bearer eyJ.abc.def", "Authorization: Bearer [REDACTED]"},
+		{"echoed my-secret-value back", "echoed [REDACTED] back"},
+	} {
+		if got := redactSecrets(tc.in, "my-secret-value"); got != tc.want {
+			t.Errorf("redactSecrets(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSecretRedactedFromErrors(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"errors": []APIErrorDetail{{Code: 500, Message: "bad request for " + r.PostForm.Get("client_secret")}},
+		})
+	})
+	c := newTestClient(t, api)
+	c.MaxRetries = 0
+
+	err := c.Authenticate()
+	if err == nil || strings.Contains(err.Error(), "test-secret") {
+		t.Fatalf("Authenticate error = %v, want it without the secret", err)
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && bytes.Contains(apiErr.Body, []byte("test-secret")) {
+		t.Errorf("APIError body keeps the secret: %s", apiErr.Body)
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	// The proxy answers for the API itself, recording the host each request was meant for
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, emptySearch)
+	var mu sync.Mutex
+	var targets []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		targets = append(targets, r.URL.Host)
+		mu.Unlock()
+		api.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	c, err := NewRTRClientWithOptions("test-id", "test-secret", WithBaseURL("http://api.crowdstrike.invalid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaxRetries = 0
+	if err := c.SetProxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.HostSearch("", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0] != "api.crowdstrike.invalid" || targets[1] != "api.crowdstrike.invalid" {
+		t.Errorf("proxied requests for %v, want the token and search requests", targets)
+	}
+
+	for _, bad := range []string{"proxy.example.com:8080", "://bad"} {
+		if err := c.SetProxy(bad); err == nil {
+			t.Errorf("SetProxy(%q) accepted", bad)
+		}
+	}
+}
+
+func TestCriteriaFilter(t *testing.T) {
+	for _, tc := range []struct {
+		field, criteria, want string
+	}{
+		{"hostname", "web-01", "hostname:'web-01'"},
+		{"hostname", "web-01, web-02,", "hostname:['web-01','web-02']"},
+		{"local_ip", "10.0.0.1,10.0.0.2", "local_ip:['10.0.0.1','10.0.0.2']"},
+		{SelectByFields["tag"], "SensorGroupingTags/prod", "tags:'SensorGroupingTags/prod'"},
+		{"platform_name", "Windows", "platform_name:'Windows'"},
+	} {
+		if got := CriteriaFilter(tc.field, tc.criteria); got != tc.want {
+			t.Errorf("CriteriaFilter(%q, %q) = %q, want %q", tc.field, tc.criteria, got, tc.want)
+		}
+	}
+}
+
+func TestSeenWithinFilter(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+		ok   bool
+	}{
+		{0, "", true},
+		{30 * time.Minute, "last_seen:>'now-30m'", true},
+		{90 * time.Minute, "last_seen:>'now-90m'", true},
+		{time.Hour, "last_seen:>'now-1h'", true},
+		{36 * time.Hour, "last_seen:>'now-36h'", true},
+		{7 * 24 * time.Hour, "last_seen:>'now-7d'", true},
+		{30 * time.Second, "", false},
+		{90 * time.Second, "", false},
+		{-time.Hour, "", false},
+	} {
+		got, err := SeenWithinFilter(tc.d)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("SeenWithinFilter(%s) = %q, %v, want %q, ok %v", tc.d, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestListScripts(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET /real-time-response/queries/scripts/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []string{"id-1", "id-2"}})
+	})
+	api.handle("GET /real-time-response/entities/scripts/v2", func(w http.ResponseWriter, r *http.Request) {
+		if ids := r.URL.Query()["ids"]; strings.Join(ids, ",") != "id-1,id-2" {
+			t.Errorf("ids = %v", ids)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []Script{
+			{ID: "id-1", Name: "collect", Platform: []string{"windows"}},
+			{ID: "id-2", Name: "triage", Platform: []string{"linux", "mac"}},
+		}})
+	})
+	c := newTestClient(t, api)
+
+	scripts, err := c.ListScripts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 2 || scripts[0].Name != "collect" || strings.Join(scripts[1].Platform, ",") != "linux,mac" {
+		t.Errorf("scripts = %+v", scripts)
+	}
+
+	// No scripts means no entity lookup
+	api.handle("GET /real-time-response/queries/scripts/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []string{}})
+	})
+	if scripts, err := c.ListScripts(); err != nil || len(scripts) != 0 {
+		t.Errorf("empty ListScripts = %+v, %v", scripts, err)
+	}
+	if got := api.count("GET /real-time-response/entities/scripts/v2"); got != 1 {
+		t.Errorf("%d entity lookups, want 1", got)
+	}
+
+	// A cancelled context stops the listing before anything is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.ListScriptsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled ListScriptsContext = %v", err)
+	}
+	if got := api.count("GET /real-time-response/queries/scripts/v1"); got != 2 {
+		t.Errorf("%d script queries, want only the 2 before cancelling", got)
+	}
+}
+
+func TestCommandRouting(t *testing.T) {
+	api := newFakeAPI(t)
+	for _, path := range []string{batchCommandPath, "/real-time-response/combined/batch-active-responder-command/v1", "/real-time-response/combined/batch-admin-command/v1"} {
+		api.handle("POST "+path, completeBatch)
+	}
+	c := newTestClient(t, api)
+
+	for _, tc := range []struct {
+		command, wantPath string
+	}{
+		{"ls C:\\", "batch-command"},
+		{"reg query HKLM\\Software", "batch-command"},
+		{"reg set HKLM\\Software -Value x", "batch-active-responder-command"},
+		{"kill 4242", "batch-active-responder-command"},
+		{"runscript -Raw=```id```", "batch-admin-command"},
+	} {
+		api.mu.Lock()
+		api.requests = nil
+		api.mu.Unlock()
+
+		base := strings.Fields(tc.command)[0]
+		if _, err := c.BatchRunCmdContext(context.Background(), "batch-1", base, tc.command, 30, "", nil); err != nil {
+			t.Fatalf("%s: %v", tc.command, err)
+		}
+		if got := api.count("POST /real-time-response/combined/" + tc.wantPath + "/v1"); got != 1 {
+			t.Errorf("%s was not sent to %s", tc.command, tc.wantPath)
+		}
+	}
+
+	if _, err := c.BatchRunCmdContext(context.Background(), "batch-1", "format", "format C:", 30, "", nil); err == nil {
+		t.Error("an unknown command was sent")
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	api := newFakeAPI(t)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "cache", "token.json")
+	newClient := func() *RTRClient {
+		c := newClientFor(t, srv.URL)
+		c.SetTokenCache(path)
+		return c
+	}
+
+	// Miss: the token is requested and written readable only by the owner
+	if err := newClient().Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("cache mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// Hit: a new client with the same credentials reuses it
+	if err := newClient().Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.count("POST /oauth2/token"); got != 1 {
+		t.Errorf("%d token requests after a cache hit, want 1", got)
+	}
+
+	// Another client ID does not use the cached token
+	other := newClient()
+	other.credentials = StaticCredentials{ClientID: "other-id", ClientSecret: "test-secret"}
+	if err := other.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.count("POST /oauth2/token"); got != 2 {
+		t.Errorf("%d token requests after a different client ID, want 2", got)
+	}
+
+	// Expired: a token inside the refresh window is requested again
+	content, _ := os.ReadFile(path)
+	var cached cachedToken
+	json.Unmarshal(content, &cached)
+	cached.ClientID = "test-id"
+	cached.ExpiresAt = time.Now().Add(30 * time.Second)
+	content, _ = json.Marshal(cached)
+	os.WriteFile(path, content, 0644)
+	if err := newClient().Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.count("POST /oauth2/token"); got != 3 {
+		t.Errorf("%d token requests after expiry, want 3", got)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("rewritten cache mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestBatchTimeoutRange(t *testing.T) {
+	for _, tc := range []struct {
+		d  time.Duration
+		ok bool
+	}{
+		{29 * time.Second, false},
+		{30 * time.Second, true},
+		{600 * time.Second, true},
+		{601 * time.Second, false},
+	} {
+		if err := CheckBatchTimeout("timeout", tc.d); (err == nil) != tc.ok {
+			t.Errorf("CheckBatchTimeout(%s) = %v, want ok %v", tc.d, err, tc.ok)
+		}
+	}
+
+	// Out-of-range values are rejected before anything is sent
+	api := newFakeAPI(t)
+	api.handle("POST "+batchCommandPath, completeBatch)
+	c := newTestClient(t, api)
+	if _, err := c.BatchCmd("batch-1", "ls", "ls", 29, "", nil); err == nil {
+		t.Error("timeout 29 was accepted")
+	}
+	if _, err := c.BatchCmd("batch-1", "ls", "ls", 30, "601s", nil); err == nil {
+		t.Error("timeout_duration 601s was accepted")
+	}
+	if _, err := c.BatchInit([]string{"host-1"}, "30", "11m"); err == nil {
+		t.Error("init timeout_duration 11m was accepted")
+	}
+	if got := api.count("POST " + batchCommandPath); got != 0 {
+		t.Errorf("%d commands sent with invalid timeouts", got)
+	}
+
+	if _, err := c.BatchCmd("batch-1", "ls", "ls", 600, "10m", nil); err != nil {
+		t.Errorf("timeout 600 with 10m: %v", err)
+	}
+}
+
+func TestNormalizeTimeoutDuration(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"600", "10m", true},
+		{"90", "90s", true},
+		{"10m", "10m", true},
+		{"10 m", "10m", true},
+		{" 30s ", "30s", true},
+		{"1m30s", "90s", true},
+		{"", "", true},
+		{"10 minutes", "", false},
+		{"10x", "", false},
+		{"1.5s", "", false},
+	} {
+		got, err := NormalizeTimeoutDuration(tc.value)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("NormalizeTimeoutDuration(%q) = %q, %v, want %q, ok %v", tc.value, got, err, tc.want, tc.ok)
+		}
+	}
+
+	// Batch init and admin commands send the normalized value
+	const adminPath = "/real-time-response/combined/batch-admin-command/v1"
+	api := newFakeAPI(t)
+	api.handle("POST /real-time-response/combined/batch-init-session/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"batch_id": "batch-1", "resources": map[string]interface{}{
+			"host-1": map[string]interface{}{"session_id": "session-1"},
+		}})
+	})
+	api.handle("POST "+adminPath, completeBatch)
+	c := newTestClient(t, api)
+	if _, err := c.BatchInit([]string{"host-1"}, "", "300"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.BatchAdminCmd("batch-1", "runscript", "runscript -Raw=```ls```", 60, "2 m", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.recorded("POST /real-time-response/combined/batch-init-session/v1")[0].Query.Get("timeout_duration"); got != "5m" {
+		t.Errorf("init timeout_duration = %q, want 5m", got)
+	}
+	if got := api.recorded("POST " + adminPath)[0].Query.Get("timeout_duration"); got != "2m" {
+		t.Errorf("admin timeout_duration = %q, want 2m", got)
+	}
+	if _, err := c.BatchAdminCmd("batch-1", "runscript", "runscript -Raw=```ls```", 60, "2 minutes", nil); err == nil {
+		t.Error("admin command accepted an invalid timeout_duration")
+	}
+}
+
+func TestSessionRefreshedDuringWait(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("POST /real-time-response/combined/batch-refresh-session/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{})
+	})
+	var mu sync.Mutex
+	polls := 0
+	api.handle("GET "+batchCommandPath, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls++
+		done := polls >= 5
+		mu.Unlock()
+		writeJSON(w, http.StatusOK, batchBody(map[string]BatchHostResponse{"host-1": {TaskID: "task-1", Complete: done}}))
+	})
+	c := newTestClient(t, api)
+	c.RefreshInterval = 10 * time.Millisecond
+
+	if _, err := c.WaitForBatchCommand("batch-1", "task-1", 10*time.Millisecond, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	refreshes := api.recorded("POST /real-time-response/combined/batch-refresh-session/v1")
+	if len(refreshes) == 0 {
+		t.Fatal("the session was not refreshed during a long wait")
+	}
+	var payload map[string]interface{}
+	json.Unmarshal(refreshes[0].Body, &payload)
+	if payload["batch_id"] != "batch-1" {
+		t.Errorf("refresh payload = %s", refreshes[0].Body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, emptySearch)
+	c := newTestClient(t, api)
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is shared by every goroutine using the client
+	const requests, perSecond = 6, 20
+	c.SetRateLimit(perSecond)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Ping(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if min := (requests - 1) * time.Second / perSecond; time.Since(start) < min {
+		t.Errorf("%d requests took %s, want at least %s at %d per second", requests, time.Since(start), min, perSecond)
+	}
+	if got := api.count("GET " + devicesQueryPath); got != requests {
+		t.Errorf("%d requests sent, want %d", got, requests)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET /real-time-response/queries/sessions/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []string{"session-1", "session-2"}})
+	})
+	api.handle("POST /real-time-response/entities/sessions/GET/v1", func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			IDs []string `json:"ids"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if strings.Join(payload.IDs, ",") != "session-1,session-2" {
+			t.Errorf("ids = %v", payload.IDs)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []map[string]interface{}{
+			{"id": "session-1", "device_id": "host-1", "hostname": "web-01", "created_at": "2024-01-02T03:04:05Z"},
+			{"id": "session-2", "device_id": "host-2", "offline_queued": true},
+		}})
+	})
+	c := newTestClient(t, api)
+
+	sessions, err := c.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("sessions = %+v", sessions)
+	}
+	if s := sessions[0]; s.ID != "session-1" || s.HostID != "host-1" || s.Hostname != "web-01" || s.CreatedAt != "2024-01-02T03:04:05Z" {
+		t.Errorf("first session = %+v", s)
+	}
+	if s := sessions[1]; s.HostID != "host-2" || !s.Offline {
+		t.Errorf("second session = %+v", s)
+	}
+
+	// No sessions means no entity lookup
+	api.handle("GET /real-time-response/queries/sessions/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"resources": []string{}})
+	})
+	if sessions, err := c.ListSessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("empty ListSessions = %+v, %v", sessions, err)
+	}
+	if got := api.count("POST /real-time-response/entities/sessions/GET/v1"); got != 1 {
+		t.Errorf("%d entity lookups, want 1", got)
+	}
+
+	// A cancelled context stops the listing before anything is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.ListSessionsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled ListSessionsContext = %v", err)
+	}
+	if got := api.count("GET /real-time-response/queries/sessions/v1"); got != 2 {
+		t.Errorf("%d session queries, want only the 2 before cancelling", got)
+	}
+}
+
+// deviceEntities answers device entity lookups with a record for each requested ID
+func deviceEntities(w http.ResponseWriter, r *http.Request) {
+	var devices []map[string]interface{}
+	for _, id := range r.URL.Query()["ids"] {
+		devices = append(devices, map[string]interface{}{
+			"device_id": id, "hostname": "name-" + id, "platform_name": "Linux", "os_version": "Ubuntu 22.04", "last_seen": "2024-01-02T03:04:05Z",
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"resources": devices})
+}
+
+func TestGetHostDetails(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET /devices/entities/devices/v2", deviceEntities)
+	c := newTestClient(t, api)
+
+	ids := make([]string, 150)
+	for i := range ids {
+		ids[i] = "host-" + strconv.Itoa(i)
+	}
+	details, err := c.GetHostDetails(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(details) != len(ids) {
+		t.Errorf("%d hosts described, want %d", len(details), len(ids))
+	}
+	if host := details["host-7"]; host.Hostname != "name-host-7" || host.PlatformName != "Linux" || host.OSVersion != "Ubuntu 22.04" || host.LastSeen != "2024-01-02T03:04:05Z" {
+		t.Errorf("host-7 = %+v", host)
+	}
+
+	// The IDs are split into lookups of at most 100
+	lookups := api.recorded("GET /devices/entities/devices/v2")
+	if len(lookups) != 2 {
+		t.Fatalf("%d lookups, want 2", len(lookups))
+	}
+	sizes := []int{len(lookups[0].Query["ids"]), len(lookups[1].Query["ids"])}
+	if sizes[0]+sizes[1] != len(ids) || sizes[0] > 100 || sizes[1] > 100 {
+		t.Errorf("lookup sizes = %v", sizes)
+	}
+}
+
+func TestGetHostDetailsChunks(t *testing.T) {
+	ids := make([]string, 250)
+	for i := range ids {
+		ids[i] = "host-" + strconv.Itoa(i)
+	}
+
+	api := newFakeAPI(t)
+	api.handle("GET /devices/entities/devices/v2", deviceEntities)
+	details, err := newTestClient(t, api).GetHostDetails(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := api.count("GET /devices/entities/devices/v2"); got != 3 {
+		t.Errorf("%d lookups, want 3", got)
+	}
+	for _, id := range ids {
+		if details[id].Hostname != "name-"+id {
+			t.Fatalf("%s = %+v, want it in the merged result", id, details[id])
+		}
+	}
+
+	// A failing chunk only loses its own hosts and is named in the error
+	api = newFakeAPI(t)
+	api.handle("GET /devices/entities/devices/v2", func(w http.ResponseWriter, r *http.Request) {
+		for _, id := range r.URL.Query()["ids"] {
+			if id == "host-150" {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []APIErrorDetail{{Code: 400, Message: "bad chunk"}}})
+				return
+			}
+		}
+		deviceEntities(w, r)
+	})
+	details, err = newTestClient(t, api).GetHostDetails(ids)
+	if err == nil || !strings.Contains(err.Error(), "hosts 101-200") || !strings.Contains(err.Error(), "bad chunk") {
+		t.Errorf("err = %v, want the failed chunk", err)
+	}
+	if len(details) != 150 || details["host-0"].Hostname == "" || details["host-249"].Hostname == "" {
+		t.Errorf("%d hosts described, want the 150 from the other chunks", len(details))
+	}
+	if _, ok := details["host-150"]; ok {
+		t.Error("a host from the failed chunk was described")
+	}
+
+	// Chunks are looked up a few at a time
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	api = newFakeAPI(t)
+	api.handle("GET /devices/entities/devices/v2", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		deviceEntities(w, r)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	})
+	if _, err := newTestClient(t, api).GetHostDetails(append(ids, ids...)); err != nil {
+		t.Fatal(err)
+	}
+	if maxInFlight < 2 || maxInFlight > hostDetailsWorkers {
+		t.Errorf("%d lookups at once, want between 2 and %d", maxInFlight, hostDetailsWorkers)
+	}
+}
+
+func TestHostFields(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET /devices/entities/devices/v2", deviceEntities)
+	c := newTestClient(t, api)
+
+	if err := c.SetHostFields([]string{"hostname", "password"}); err == nil {
+		t.Error("SetHostFields accepted an unknown field")
+	}
+
+	if err := c.SetHostFields([]string{" os_version", "hostname", "os_version"}); err != nil {
+		t.Fatal(err)
+	}
+	details, err := c.GetHostDetails([]string{"aaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := api.recorded("GET /devices/entities/devices/v2")[0].Query.Get("fields"); got != "device_id,os_version,hostname" {
+		t.Errorf("fields = %q", got)
+	}
+	want := map[string]interface{}{"device_id": "aaa", "os_version": "Ubuntu 22.04", "hostname": "name-aaa"}
+	if host := details["aaa"]; !reflect.DeepEqual(host.Fields, want) || host.Hostname != "name-aaa" {
+		t.Errorf("aaa = %+v, want only the requested fields", host)
+	}
+
+	// An empty list goes back to full records
+	if err := c.SetHostFields(nil); err != nil {
+		t.Fatal(err)
+	}
+	api.mu.Lock()
+	api.requests = nil
+	api.mu.Unlock()
+	details, err = c.GetHostDetails([]string{"aaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query := api.recorded("GET /devices/entities/devices/v2")[0].Query; query.Has("fields") {
+		t.Errorf("full record lookup sent fields: %v", query)
+	}
+	if host := details["aaa"]; host.Fields != nil || host.PlatformName != "Linux" {
+		t.Errorf("full record = %+v", host)
+	}
+}
+
+func TestMemberCID(t *testing.T) {
+	api := newFakeAPI(t)
+	c := newTestClient(t, api)
+
+	for _, cid := range []string{"", "abc", "0123456789abcdef0123456789abcdeg", "0123456789abcdef0123456789abcdef-1"} {
+		if err := c.SetMemberCID(cid); err == nil {
+			t.Errorf("SetMemberCID(%q) was accepted", cid)
+		}
+	}
+
+	// Not setting a CID leaves it out of the token request
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	form, _ := url.ParseQuery(string(api.recorded("POST /oauth2/token")[0].Body))
+	if _, ok := form["member_cid"]; ok {
+		t.Errorf("token request without a CID = %v", form)
+	}
+
+	// The checksum suffix is dropped and the CID lowercased
+	if err := c.SetMemberCID("0123456789ABCDEF0123456789ABCDEF-A7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	form, _ = url.ParseQuery(string(api.recorded("POST /oauth2/token")[1].Body))
+	if got := form.Get("member_cid"); got != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("member_cid = %q", got)
+	}
+}
+
+func TestConcurrentTokenRefresh(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, emptySearch)
+	c := newTestClient(t, api)
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refreshes and header reads overlap; run with -race to check the headers are guarded
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := c.Authenticate(); err != nil {
+				t.Error(err)
+			}
+			c.setHeader("X-Test", "refreshed")
+		}()
+		go func() {
+			defer wg.Done()
+			if got := c.authHeader(); got != "Bearer test-token" {
+				t.Errorf("authHeader = %q", got)
+			}
+			if got := c.headerSnapshot()["Authorization"]; got != "Bearer test-token" {
+				t.Errorf("snapshot Authorization = %q", got)
+			}
+			if err := c.Ping(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, req := range api.recorded("GET " + devicesQueryPath) {
+		if got := req.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("request sent with Authorization %q", got)
+		}
+	}
+}
+
+func TestAuthenticateHTMLResponse(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "<html><title>Proxy login required</title>\n<body>Sign in</body></html>\n")
+	})
+	c := newTestClient(t, api)
+
+	err := c.Authenticate()
+	if err == nil {
+		t.Fatal("an HTML page was accepted as a token response")
+	}
+	for _, want := range []string{`content type "text/html; charset=utf-8"`, "<html><title>Proxy login required</title>"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "Sign in") {
+		t.Errorf("error %q includes more than the first line", err)
+	}
+}
+
+func TestCredentialsRejected(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{http.StatusBadRequest, `{"error":"invalid_client","error_description":"Client authentication failed"}`, true},
+		{http.StatusUnauthorized, `{"errors":[{"code":401,"message":"access denied, invalid client credentials"}]}`, true},
+		{http.StatusForbidden, `{"errors":[{"code":403,"message":"access denied, authorization failed"}]}`, true},
+		{http.StatusBadRequest, `{"errors":[{"code":400,"message":"invalid member_cid"}]}`, false},
+		{http.StatusServiceUnavailable, `{"errors":[{"code":503,"message":"access denied by upstream"}]}`, false},
+	} {
+		api := newFakeAPI(t)
+		api.handle("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		})
+		c := newTestClient(t, api)
+
+		err := c.Authenticate()
+		if err == nil {
+			t.Fatalf("%d %s: Authenticate succeeded", tc.status, tc.body)
+		}
+		if got := errors.Is(err, ErrCredentialsRejected); got != tc.want {
+			t.Errorf("%d %s: error %q, rejected = %v, want %v", tc.status, tc.body, err, got, tc.want)
+		}
+		// The API error stays reachable for its status code and trace ID either way
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != tc.status {
+			t.Errorf("%d: error %q does not wrap the API error", tc.status, err)
+		}
+		if tc.want {
+			// The friendly message comes first and the API's own error is kept for support cases
+			if !strings.HasPrefix(err.Error(), "credentials rejected: check CLIENT_ID/CLIENT_SECRET") || !strings.Contains(err.Error(), strconv.Itoa(tc.status)) {
+				t.Errorf("%d: error = %q", tc.status, err)
+			}
+			if got := api.count("POST /oauth2/token"); got != 1 {
+				t.Errorf("%d: rejected credentials were sent %d times", tc.status, got)
+			}
+		}
+	}
+}
+
+func TestRequiredScopes(t *testing.T) {
+	for command, want := range map[string]string{
+		"ls C:\\":               "devices:read real-time-response:read",
+		"reg query HKLM":        "devices:read real-time-response:read",
+		"reg delete HKLM\\x":    "devices:read real-time-response:write",
+		"kill 4242":             "devices:read real-time-response:write",
+		"runscript -Raw=``````": "devices:read real-time-response-admin:write",
+		"format C:":             "",
+		"":                      "",
+	} {
+		if got := strings.Join(RequiredScopes(command), " "); got != want {
+			t.Errorf("RequiredScopes(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	scope := ""
+	api := newFakeAPI(t)
+	api.handle("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"access_token": "test-token", "token_type": "bearer", "expires_in": 1800, "scope": scope})
+	})
+	c := newTestClient(t, api)
+	required := RequiredScopes("runscript -CloudFile=\"collect\"")
+
+	// Without a scope list nothing can be checked
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if missing, known := c.MissingScopes(required); known || missing != nil {
+		t.Errorf("unlisted scopes = %v, %v, want unknown", missing, known)
+	}
+
+	scope = "devices:read real-time-response:read real-time-response:write"
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if missing, known := c.MissingScopes(required); !known || strings.Join(missing, ",") != "real-time-response-admin:write" {
+		t.Errorf("MissingScopes = %v, %v, want the admin scope", missing, known)
+	}
+	if missing, _ := c.MissingScopes(RequiredScopes("ls")); len(missing) != 0 {
+		t.Errorf("read command is missing %v", missing)
+	}
+}
+
+func TestRetrySendsFullBody(t *testing.T) {
+	const initPath = "/real-time-response/combined/batch-init-session/v1"
+	api := newFakeAPI(t)
+	api.handle("POST "+initPath, statusSequence([]int{503}, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"batch_id": "batch-1", "resources": map[string]interface{}{
+			"host-1": map[string]interface{}{"session_id": "session-1"},
+		}})
+	}))
+	// A redirect re-sends the body through GetBody
+	api.handle("POST "+batchCommandPath, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moved", http.StatusTemporaryRedirect)
+	})
+	api.handle("POST /moved", completeBatch)
+	c := newTestClient(t, api)
+	c.MaxRetries = 1
+
+	if _, err := c.BatchInit([]string{"host-1"}, "30", "30s"); err != nil {
+		t.Fatal(err)
+	}
+	attempts := api.recorded("POST " + initPath)
+	if len(attempts) != 2 {
+		t.Fatalf("%d init attempts, want 2", len(attempts))
+	}
+	if len(attempts[0].Body) == 0 || !bytes.Equal(attempts[0].Body, attempts[1].Body) {
+		t.Errorf("retried body = %q, first attempt = %q", attempts[1].Body, attempts[0].Body)
+	}
+
+	if _, err := c.BatchCmd("batch-1", "ls", "ls C:\\", 30, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	sent, moved := api.recorded("POST "+batchCommandPath), api.recorded("POST /moved")
+	if len(moved) != 1 || len(sent[0].Body) == 0 || !bytes.Equal(sent[0].Body, moved[0].Body) {
+		t.Errorf("redirected body = %q, original = %q", moved, sent[0].Body)
+	}
+}
+
+func TestOnHostResult(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+batchCommandPath, pollSequence(
+		map[string]BatchHostResponse{"host-1": {Complete: true, Stdout: "one"}, "host-2": {}, "host-3": {}},
+		map[string]BatchHostResponse{"host-1": {Complete: true, Stdout: "one"}, "host-2": {Complete: true, Stdout: "two"}, "host-3": {}},
+		map[string]BatchHostResponse{"host-1": {Complete: true, Stdout: "one"}, "host-2": {Complete: true, Stdout: "two"}, "host-3": {Complete: true, Stdout: "three"}},
+	))
+	c := newTestClient(t, api)
+	var order []string
+	c.OnHostResult = func(r HostResult) {
+		if !r.Complete || r.Stdout == "" {
+			t.Errorf("incomplete result reported: %+v", r)
+		}
+		order = append(order, r.HostID)
+	}
+
+	if _, err := c.WaitForBatchCommand("batch-1", "task-1", time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.count("GET " + batchCommandPath); got != 3 {
+		t.Errorf("%d polls, want 3", got)
+	}
+	// Each host is reported once, as soon as the poll shows it complete
+	if strings.Join(order, ",") != "host-1,host-2,host-3" {
+		t.Errorf("reported %v, want each host once in completion order", order)
+	}
+}
+
+func TestTraceIDInErrors(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cs-Traceid", "trace-from-header")
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []APIErrorDetail{{Code: 403, Message: "denied"}}})
+	})
+	c := newTestClient(t, api)
+	var logs bytes.Buffer
+	c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	_, err := c.HostSearch("", "", "", 0)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.TraceID != "trace-from-header" {
+		t.Fatalf("error = %#v, want the trace ID", err)
+	}
+	if !strings.Contains(err.Error(), "trace ID trace-from-header") {
+		t.Errorf("error %q does not mention the trace ID", err)
+	}
+	if !strings.Contains(logs.String(), "trace_id=trace-from-header") {
+		t.Errorf("debug log does not mention the trace ID:\n%s", logs.String())
+	}
+
+	// Without the header the ID is taken from the error envelope
+	api.handle("GET "+devicesQueryPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{
+			"meta":   map[string]interface{}{"trace_id": "trace-from-body"},
+			"errors": []APIErrorDetail{{Code: 403, Message: "denied"}},
+		})
+	})
+	if _, err := c.HostSearch("", "", "", 0); err == nil || !strings.Contains(err.Error(), "trace ID trace-from-body") {
+		t.Errorf("error %v does not mention the envelope trace ID", err)
+	}
+}
+
+func TestNewRTRClientAuthenticate(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, emptySearch)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	c := NewRTRClient("test-id", "test-secret", srv.URL+"/", true)
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := c.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	tokens := api.recorded("POST /oauth2/token")
+	if len(tokens) != 1 {
+		t.Fatalf("%d token requests, want 1", len(tokens))
+	}
+	form, _ := url.ParseQuery(string(tokens[0].Body))
+	if form.Get("client_id") != "test-id" || form.Get("client_secret") != "test-secret" {
+		t.Errorf("token request form = %v", form)
+	}
+	if got := tokens[0].Header.Get("Content-Type"); got != "application/x-www-form-urlencoded" {
+		t.Errorf("token request Content-Type = %q", got)
+	}
+
+	// Later calls carry the token
+	if _, err := c.HostSearch("", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.recorded("GET " + devicesQueryPath)[0].Header.Get("Authorization"); got != "Bearer test-token" {
+		t.Errorf("Authorization = %q", got)
+	}
+
+	if c := NewRTRClient("id", "secret", "", true); c.authURL != "https://api.crowdstrike.com" || c.baseURL != "https://api.crowdstrike.com/real-time-response" {
+		t.Errorf("default URLs = %s, %s", c.authURL, c.baseURL)
+	}
+}
+
+// rotatingCredentials returns a new secret on every call, as a secrets manager might after rotation
+type rotatingCredentials struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+}
+
+func (r *rotatingCredentials) Credentials() (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls++
+	if r.err != nil {
+		return "", "", r.err
+	}
+	return "rotating-id", "secret-" + strconv.Itoa(r.calls), nil
+}
+
+func TestCredentialProvider(t *testing.T) {
+	api := newFakeAPI(t)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	provider := &rotatingCredentials{}
+	c, err := NewRTRClientWithOptions("ignored-id", "ignored-secret", WithBaseURL(srv.URL), WithCredentialProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Each token request asks the provider again, so the rotated secret is used the second time
+	for i := 0; i < 2; i++ {
+		if err := c.Authenticate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokens := api.recorded("POST /oauth2/token")
+	if len(tokens) != 2 {
+		t.Fatalf("%d token requests, want 2", len(tokens))
+	}
+	for i, want := range []string{"secret-1", "secret-2"} {
+		form, _ := url.ParseQuery(string(tokens[i].Body))
+		if form.Get("client_id") != "rotating-id" || form.Get("client_secret") != want {
+			t.Errorf("token request %d = %v, want secret %s", i+1, form, want)
+		}
+	}
+
+	// A provider failure is returned without calling the API
+	provider.err = errors.New("vault sealed")
+	if err := c.Authenticate(); err == nil || !strings.Contains(err.Error(), "vault sealed") {
+		t.Errorf("Authenticate with a failing provider = %v", err)
+	}
+	if got := api.count("POST /oauth2/token"); got != 2 {
+		t.Errorf("%d token requests after a provider failure, want 2", got)
+	}
+
+	empty, err := NewRTRClientWithOptions("", "", WithBaseURL(srv.URL), WithCredentialProvider(StaticCredentials{ClientID: "id"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.Authenticate(); err == nil {
+		t.Error("Authenticate accepted an empty secret")
+	}
+	if _, err := NewRTRClientWithOptions("id", "secret", WithCredentialProvider(nil)); err == nil {
+		t.Error("WithCredentialProvider accepted nil")
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	newClient := func(opts ...Option) *RTRClient {
+		t.Helper()
+		c, err := NewRTRClientWithOptions("id", "secret", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := newClient()
+	if c.apiURL != "https://api.crowdstrike.com" || c.httpClient.Timeout != 30*time.Second || c.MaxRetries != 3 {
+		t.Errorf("defaults: URL %s, timeout %s, retries %d", c.apiURL, c.httpClient.Timeout, c.MaxRetries)
+	}
+
+	if c := newClient(WithBaseURL("https://gateway.example.com/")); c.authURL != "https://gateway.example.com" || c.baseURL != "https://gateway.example.com/real-time-response" {
+		t.Errorf("WithBaseURL: %s, %s", c.authURL, c.baseURL)
+	}
+	if c := newClient(WithRegion("EU-1")); c.apiURL != "https://api.eu-1.crowdstrike.com" {
+		t.Errorf("WithRegion: %s", c.apiURL)
+	}
+	if c := newClient(WithTimeout(5 * time.Second)); c.httpClient.Timeout != 5*time.Second {
+		t.Errorf("WithTimeout: %s", c.httpClient.Timeout)
+	}
+	if c := newClient(WithInsecureSkipVerify()); !c.httpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify {
+		t.Error("WithInsecureSkipVerify did not disable verification")
+	}
+	custom := &http.Client{Timeout: time.Second}
+	if c := newClient(WithHTTPClient(custom)); c.httpClient != custom {
+		t.Error("WithHTTPClient did not replace the client")
+	}
+	provider := StaticCredentials{ClientID: "provided-id", ClientSecret: "provided-secret"}
+	if c := newClient(WithCredentialProvider(provider)); c.credentials != provider {
+		t.Errorf("WithCredentialProvider: %+v", c.credentials)
+	}
+
+	// Options apply in order, so a later base URL wins over a region
+	if c := newClient(WithRegion("us-2"), WithBaseURL("https://later.example.com")); c.apiURL != "https://later.example.com" {
+		t.Errorf("later option lost: %s", c.apiURL)
+	}
+
+	for name, opt := range map[string]Option{
+		"unknown region":        WithRegion("mars-1"),
+		"nil HTTP client":       WithHTTPClient(nil),
+		"nil provider":          WithCredentialProvider(nil),
+		"skip verify on custom": func(c *RTRClient) error { c.httpClient = custom; return WithInsecureSkipVerify()(c) },
+	} {
+		if _, err := NewRTRClientWithOptions("id", "secret", opt); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
+
+// recordingTransport passes requests to http.DefaultTransport and records "METHOD path" for each
+type recordingTransport struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, req.Method+" "+req.URL.Path)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestInjectedHTTPClient(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, pagedSearch([]string{"host-1"}, 10))
+	api.handle("POST /real-time-response/combined/batch-init-session/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"batch_id": "batch-1", "resources": map[string]interface{}{
+			"host-1": map[string]interface{}{"session_id": "session-1"},
+		}})
+	})
+	api.handle("POST "+batchCommandPath, completeBatch)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	transport := &recordingTransport{}
+	c, err := NewRTRClientWithOptions("test-id", "test-secret", WithBaseURL(srv.URL), WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	hosts, err := c.HostSearch("", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchID, err := c.BatchInit(hosts, "30", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.BatchCmd(batchID, "ls", "ls", 30, "", hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"POST /oauth2/token",
+		"GET " + devicesQueryPath,
+		"POST /real-time-response/combined/batch-init-session/v1",
+		"POST " + batchCommandPath,
+	}
+	if strings.Join(transport.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("transport saw %q, want %q", transport.requests, want)
+	}
+}
+
+func TestNoPacingWithoutRateLimit(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("GET "+devicesQueryPath, emptySearch)
+	c := newTestClient(t, api)
+	c.SetRateLimit(5)
+	c.SetRateLimit(0)
+	if c.limiter != nil {
+		t.Fatal("SetRateLimit(0) kept the limiter")
+	}
+
+	// At 5 per second these would take about 4 seconds
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if err := c.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("20 unpaced requests took %s", elapsed)
+	}
+}
+
+func TestTokenType(t *testing.T) {
+	for _, tc := range []struct {
+		tokenType string
+		ok        bool
+	}{
+		{"bearer", true},
+		{"Bearer", true},
+		{"BEARER", true},
+		{"", true},
+		{"mac", false},
+		{"Basic", false},
+	} {
+		api := newFakeAPI(t)
+		api.handle("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"access_token": "test-token", "token_type": tc.tokenType, "expires_in": 1800})
+		})
+		c := newTestClient(t, api)
+
+		err := c.Authenticate()
+		if (err == nil) != tc.ok {
+			t.Errorf("token_type %q: %v, want ok %v", tc.tokenType, err, tc.ok)
+			continue
+		}
+		if tc.ok && c.authHeader() != "Bearer test-token" {
+			t.Errorf("token_type %q: Authorization = %q", tc.tokenType, c.authHeader())
+		}
+		if !tc.ok && (c.authHeader() != "" || !strings.Contains(err.Error(), "unsupported token type")) {
+			t.Errorf("token_type %q: error %v, Authorization %q", tc.tokenType, err, c.authHeader())
+		}
+	}
+}
+
+func TestBatchInitPartialFailure(t *testing.T) {
+	api := newFakeAPI(t)
+	api.handle("POST /real-time-response/combined/batch-init-session/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"batch_id": "batch-1", "resources": map[string]interface{}{
+			"ok-1":    map[string]interface{}{"session_id": "session-1", "complete": true},
+			"busy":    map[string]interface{}{"errors": []map[string]interface{}{{"code": 40007, "message": "host already in a session"}, {"code": 1, "message": "retry later"}}},
+			"stderr":  map[string]interface{}{"stderr": "unsupported platform"},
+			"empty":   map[string]interface{}{},
+			"ok-2":    map[string]interface{}{"session_id": "session-2"},
+			"unasked": map[string]interface{}{"session_id": "session-3"},
+		}})
+	})
+	c := newTestClient(t, api)
+
+	hosts := []string{"ok-1", "busy", "stderr", "empty", "missing", "ok-2"}
+	result, err := c.BatchInitHostsContext(context.Background(), hosts, "30", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BatchID != "batch-1" {
+		t.Errorf("batch ID = %q", result.BatchID)
+	}
+	if got := strings.Join(result.Initialized(hosts), ","); got != "ok-1,ok-2" {
+		t.Errorf("initialized = %s, want ok-1,ok-2", got)
+	}
+	for host, want := range map[string]string{
+		"busy":    "host already in a session; retry later",
+		"stderr":  "unsupported platform",
+		"empty":   "no session was opened",
+		"missing": "not included in the batch init response",
+	} {
+		if got := result.Failed[host]; got != want {
+			t.Errorf("%s failed with %q, want %q", host, got, want)
+		}
+	}
+	if len(result.Failed) != 4 {
+		t.Errorf("failed = %v", result.Failed)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	const sessionsPath = "/real-time-response/entities/sessions/v1"
+	api := newFakeAPI(t)
+	api.handle("DELETE "+sessionsPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("session_id") {
+		case "live":
+			w.WriteHeader(http.StatusNoContent)
+		case "gone":
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []APIErrorDetail{{Code: 404, Message: "Session not found"}}})
+		default:
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []APIErrorDetail{{Code: 403, Message: "access denied"}}})
+		}
+	})
+	c := newTestClient(t, api)
+
+	if err := c.DeleteSession("live"); err != nil {
+		t.Errorf("deleting a live session = %v", err)
+	}
+	if err := c.DeleteSession("gone"); !errors.Is(err, ErrSessionNotFound) || !strings.Contains(err.Error(), "gone") {
+		t.Errorf("deleting a missing session = %v, want ErrSessionNotFound", err)
+	}
+	var apiErr *APIError
+	if err := c.DeleteSession("other"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("deleting a forbidden session = %v, want an API error", err)
+	}
+	if err := c.DeleteSession(""); err == nil {
+		t.Error("an empty session ID was accepted")
+	}
+	if got := api.count("DELETE " + sessionsPath); got != 3 {
+		t.Errorf("%d delete requests, want 3", got)
+	}
+}